@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/javaman/go-metrics/internal/config"
+	"github.com/javaman/go-metrics/internal/model"
+)
+
+type collectorFactory func(conf *config.AgentConfiguration) (Measured, error)
+
+type collectorRegistry struct {
+	factories map[string]collectorFactory
+}
+
+func newCollectorRegistry() *collectorRegistry {
+	r := &collectorRegistry{make(map[string]collectorFactory)}
+	r.register("memstats", func(*config.AgentConfiguration) (Measured, error) {
+		return &defaultMeasured{}, nil
+	})
+	r.register("runtime", func(*config.AgentConfiguration) (Measured, error) {
+		return newRuntimeMeasured(), nil
+	})
+	r.register("process", func(*config.AgentConfiguration) (Measured, error) {
+		return newProcessMeasured(), nil
+	})
+	r.register("host", func(*config.AgentConfiguration) (Measured, error) {
+		return newHostMeasured(), nil
+	})
+	r.register("gcpause", func(conf *config.AgentConfiguration) (Measured, error) {
+		return newGCPauseMeasured(conf.HistogramBuckets)
+	})
+	r.register("script", func(conf *config.AgentConfiguration) (Measured, error) {
+		if conf.CollectorScript == "" {
+			return nil, fmt.Errorf("script collector requires a command")
+		}
+		return &scriptMeasured{conf.CollectorScript, time.Duration(conf.PollInterval) * time.Second}, nil
+	})
+	return r
+}
+
+func (r *collectorRegistry) register(name string, factory collectorFactory) {
+	r.factories[name] = factory
+}
+
+func (r *collectorRegistry) names() []string {
+	result := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (r *collectorRegistry) build(conf *config.AgentConfiguration) ([]Measured, error) {
+	var result []Measured
+	for _, name := range conf.Collectors {
+		factory, ok := r.factories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown collector %q, available: %s", name, strings.Join(r.names(), ", "))
+		}
+		m, err := factory(conf)
+		if err != nil {
+			return nil, fmt.Errorf("collector %s: %w", name, err)
+		}
+		if prefix := conf.CollectorPrefixes[name]; prefix != "" {
+			m = &prefixedMeasured{m, prefix}
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+type prefixedDestination struct {
+	MeasureDestination
+	prefix string
+}
+
+func (d *prefixedDestination) saveCounter(m Measure, value int64) {
+	d.MeasureDestination.saveCounter(CounterMeasure{value, d.prefix + m.name()}, value)
+}
+
+func (d *prefixedDestination) saveGauge(m Measure, value float64) {
+	d.MeasureDestination.saveGauge(GaugeMeasure{value, d.prefix + m.name()}, value)
+}
+
+func (d *prefixedDestination) saveHistogram(m Measure, value model.Histogram) {
+	d.MeasureDestination.saveHistogram(HistogramMeasure{value, d.prefix + m.name()}, value)
+}
+
+type prefixedMeasured struct {
+	Measured
+	prefix string
+}
+
+func (p *prefixedMeasured) captureMetrics(destination MeasureDestination) {
+	p.Measured.captureMetrics(&prefixedDestination{destination, p.prefix})
+}
+
+type runtimeMeasured struct {
+	names   map[string]string
+	samples []metrics.Sample
+}
+
+func newRuntimeMeasured() *runtimeMeasured {
+	names := map[string]string{
+		"/sched/goroutines:goroutines": "Goroutines",
+		"/gc/cycles/total:gc-cycles":   "GCCycles",
+		"/gc/cycles/forced:gc-cycles":  "GCForcedCycles",
+		"/gc/heap/allocs:bytes":        "GCHeapAllocsBytes",
+		"/gc/heap/frees:bytes":         "GCHeapFreesBytes",
+		"/gc/heap/objects:objects":     "GCHeapObjects",
+		"/gc/heap/goal:bytes":          "GCHeapGoalBytes",
+		"/memory/classes/total:bytes":  "MemoryTotalBytes",
+	}
+	supported := make(map[string]bool)
+	for _, d := range metrics.All() {
+		supported[d.Name] = true
+	}
+	r := &runtimeMeasured{names: make(map[string]string)}
+	for key, name := range names {
+		if supported[key] {
+			r.names[key] = name
+			r.samples = append(r.samples, metrics.Sample{Name: key})
+		}
+	}
+	return r
+}
+
+func (r *runtimeMeasured) captureMetrics(destination MeasureDestination) {
+	metrics.Read(r.samples)
+	for _, sample := range r.samples {
+		switch sample.Value.Kind() {
+		case metrics.KindUint64:
+			GaugeMeasure{float64(sample.Value.Uint64()), r.names[sample.Name]}.save(destination)
+		case metrics.KindFloat64:
+			GaugeMeasure{sample.Value.Float64(), r.names[sample.Name]}.save(destination)
+		}
+	}
+}
+
+type gcPauseMeasured struct {
+	bounds []float64
+	numGC  uint32
+}
+
+func newGCPauseMeasured(bounds []float64) (*gcPauseMeasured, error) {
+	if h := model.NewHistogram(bounds); h.Validate() != nil {
+		return nil, fmt.Errorf("histogram buckets %v must be finite and increasing", bounds)
+	}
+	return &gcPauseMeasured{bounds: bounds}, nil
+}
+
+func (g *gcPauseMeasured) captureMetrics(destination MeasureDestination) {
+	memStats := new(runtime.MemStats)
+	runtime.ReadMemStats(memStats)
+
+	h := model.NewHistogram(g.bounds)
+	first := g.numGC
+	if memStats.NumGC-first > uint32(len(memStats.PauseNs)) {
+		first = memStats.NumGC - uint32(len(memStats.PauseNs))
+	}
+	for i := first; i < memStats.NumGC; i++ {
+		h.Observe(time.Duration(memStats.PauseNs[i%uint32(len(memStats.PauseNs))]).Seconds())
+	}
+	g.numGC = memStats.NumGC
+
+	HistogramMeasure{h, "GCPause"}.save(destination)
+}
+
+type scriptMeasured struct {
+	command string
+	timeout time.Duration
+}
+
+func (s *scriptMeasured) captureMetrics(destination MeasureDestination) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "sh", "-c", s.command).Output()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := parseScriptOutput(out, destination); err != nil {
+		log.Println(err)
+	}
+}
+
+func parseScriptOutput(out []byte, destination MeasureDestination) error {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("script output %q should be in \"name type value\" format", scanner.Text())
+		}
+		switch fields[1] {
+		case "gauge":
+			v, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				return fmt.Errorf("script gauge %s: %w", fields[0], err)
+			}
+			GaugeMeasure{v, fields[0]}.save(destination)
+		case "counter":
+			v, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return fmt.Errorf("script counter %s: %w", fields[0], err)
+			}
+			CounterMeasure{v, fields[0]}.save(destination)
+		default:
+			return fmt.Errorf("script metric %s: unknown type %q", fields[0], fields[1])
+		}
+	}
+	return scanner.Err()
+}
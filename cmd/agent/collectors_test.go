@@ -0,0 +1,86 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/javaman/go-metrics/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func namesOf(measures []Measure) map[string]bool {
+	result := make(map[string]bool)
+	for _, m := range measures {
+		result[m.name()] = true
+	}
+	return result
+}
+
+func TestCollectorRegistryBuild(t *testing.T) {
+	conf := &config.AgentConfiguration{
+		PollInterval:      2,
+		Collectors:        []string{"memstats", "runtime"},
+		CollectorPrefixes: map[string]string{"runtime": "rt_"},
+	}
+	sources, err := newCollectorRegistry().build(conf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(sources))
+
+	mb := &measuresBuffer{}
+	for _, source := range sources {
+		source.captureMetrics(mb)
+	}
+	names := namesOf(mb.buffer)
+	assert.True(t, names["Alloc"])
+	assert.True(t, names["rt_Goroutines"])
+	assert.False(t, names["Goroutines"])
+}
+
+func TestCollectorRegistryUnknown(t *testing.T) {
+	_, err := newCollectorRegistry().build(&config.AgentConfiguration{Collectors: []string{"nope"}})
+	assert.Error(t, err)
+
+	_, err = newCollectorRegistry().build(&config.AgentConfiguration{Collectors: []string{"script"}})
+	assert.Error(t, err)
+}
+
+func TestScriptMeasured(t *testing.T) {
+	sources, err := newCollectorRegistry().build(&config.AgentConfiguration{
+		PollInterval:    2,
+		Collectors:      []string{"script"},
+		CollectorScript: "echo 'QueueLength gauge 3.5'; echo 'Jobs counter 7'",
+	})
+	require.NoError(t, err)
+
+	mb := &measuresBuffer{}
+	sources[0].captureMetrics(mb)
+
+	assert.Equal(t, []Measure{GaugeMeasure{3.5, "QueueLength"}, CounterMeasure{7, "Jobs"}}, mb.buffer)
+}
+
+func TestParseScriptOutputInvalid(t *testing.T) {
+	assert.Error(t, parseScriptOutput([]byte("QueueLength gauge"), &measuresBuffer{}))
+	assert.Error(t, parseScriptOutput([]byte("QueueLength histogram 1"), &measuresBuffer{}))
+	assert.Error(t, parseScriptOutput([]byte("Jobs counter 1.5"), &measuresBuffer{}))
+}
+
+func TestGCPauseMeasured(t *testing.T) {
+	g, err := newGCPauseMeasured([]float64{0.001, 1})
+	require.NoError(t, err)
+
+	mb := &measuresBuffer{}
+	g.captureMetrics(mb)
+	runtime.GC()
+	runtime.GC()
+	g.captureMetrics(mb)
+	require.Equal(t, 2, len(mb.buffer))
+
+	h := mb.buffer[1].(HistogramMeasure)
+	assert.Equal(t, "GCPause", h.name())
+	assert.GreaterOrEqual(t, h.value.Count, uint64(2))
+	assert.NoError(t, h.value.Validate())
+
+	_, err = newGCPauseMeasured([]float64{1, 0.1})
+	assert.Error(t, err)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/javaman/go-metrics/internal/proto"
+	"github.com/javaman/go-metrics/internal/retry"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type grpcSender struct {
+	client      pb.MetricsClient
+	key         string
+	retryDelays []time.Duration
+	labels      map[string]string
+	realIP      string
+}
+
+// isRetriableGRPC accepts only updates the server reports as not applied. Unavailable and DeadlineExceeded
+// may come after the server applied them; RPCs that never left the agent are retried by gRPC itself.
+func isRetriableGRPC(err error) bool {
+	return status.Code(err) == codes.Aborted
+}
+
+func (s *grpcSender) sendBatch(measures []Measure) error {
+	if len(measures) == 0 {
+		return nil
+	}
+	req := pb.FromModelBatch(newMetricsBatch(measures, s.labels))
+
+	ctx := context.Background()
+	if s.realIP != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, pb.MetadataRealIP, s.realIP)
+	}
+	if s.key != "" {
+		signature, err := pb.Sign(s.key, req)
+		if err != nil {
+			return err
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, pb.MetadataHashSHA256, signature)
+	}
+	return retry.Do(context.Background(), s.retryDelays, isRetriableGRPC, func() error {
+		_, err := s.client.UpdateBatch(ctx, req)
+		return err
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/javaman/go-metrics/internal/grpcserver"
+	pb "github.com/javaman/go-metrics/internal/proto"
+	"github.com/javaman/go-metrics/internal/repository"
+	"github.com/javaman/go-metrics/internal/services"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCSenderSendBatch(t *testing.T) {
+	storage := repository.NewInMemoryStorage()
+	listener := bufconn.Listen(1024 * 1024)
+	s := grpcserver.New(services.NewMetricsService(storage), "secret", nil)
+	go s.Serve(listener)
+	defer s.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sender := &grpcSender{client: pb.NewMetricsClient(conn), key: "secret", labels: map[string]string{"host": "h1"}}
+	assert.NoError(t, sender.sendBatch([]Measure{GaugeMeasure{2.72, "e"}, CounterMeasure{42, "c"}}))
+
+	e, found, _ := storage.GetGauge(`e{host="h1"}`)
+	assert.True(t, found)
+	assert.Equal(t, 2.72, e)
+	c, found, _ := storage.GetCounter(`c{host="h1"}`)
+	assert.True(t, found)
+	assert.Equal(t, int64(42), c)
+
+	sender.key = "wrong"
+	assert.Error(t, sender.sendBatch([]Measure{GaugeMeasure{2.72, "e"}}))
+}
+
+func TestGRPCSenderRealIP(t *testing.T) {
+	storage := repository.NewInMemoryStorage()
+	_, subnet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	listener := bufconn.Listen(1024 * 1024)
+	s := grpcserver.New(services.NewMetricsService(storage), "", nil, grpcserver.TrustedSubnet(subnet)...)
+	go s.Serve(listener)
+	defer s.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sender := &grpcSender{client: pb.NewMetricsClient(conn), realIP: "10.0.0.7"}
+	assert.NoError(t, sender.sendBatch([]Measure{GaugeMeasure{2.72, "e"}}))
+	_, found, _ := storage.GetGauge("e")
+	assert.True(t, found)
+
+	sender.realIP = "192.168.0.7"
+	assert.Error(t, sender.sendBatch([]Measure{GaugeMeasure{2.72, "e"}}))
+}
+
+type failingMetricsClient struct {
+	pb.MetricsClient
+	errs  []error
+	calls int
+}
+
+func (f *failingMetricsClient) UpdateBatch(ctx context.Context, in *pb.MetricsBatch, opts ...grpc.CallOption) (*pb.MetricsBatch, error) {
+	f.calls++
+	if len(f.errs) == 0 {
+		return in, nil
+	}
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return nil, err
+}
+
+func TestGRPCSenderRetriesOnlyNotApplied(t *testing.T) {
+	delays := []time.Duration{time.Millisecond, time.Millisecond}
+
+	client := &failingMetricsClient{errs: []error{status.Error(codes.Aborted, "not applied"), status.Error(codes.Aborted, "not applied")}}
+	sender := &grpcSender{client: client, retryDelays: delays}
+	assert.NoError(t, sender.sendBatch([]Measure{CounterMeasure{1, "c"}}))
+	assert.Equal(t, 3, client.calls)
+
+	for _, code := range []codes.Code{codes.Unavailable, codes.DeadlineExceeded, codes.Internal} {
+		client = &failingMetricsClient{errs: []error{status.Error(code, "may be applied")}}
+		sender = &grpcSender{client: client, retryDelays: delays}
+		assert.Error(t, sender.sendBatch([]Measure{CounterMeasure{1, "c"}}))
+		assert.Equal(t, 1, client.calls, code.String())
+	}
+}
@@ -0,0 +1,130 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type cpuTimes struct {
+	idle  uint64
+	total uint64
+}
+
+type hostMeasured struct {
+	procPath string
+	previous map[int]cpuTimes
+}
+
+func newHostMeasured() *hostMeasured {
+	return &hostMeasured{procPath: "/proc"}
+}
+
+func (h *hostMeasured) captureMetrics(destination MeasureDestination) {
+	if err := h.captureMemory(destination); err != nil {
+		log.Println(err)
+	}
+	if err := h.captureCPU(destination); err != nil {
+		log.Println(err)
+	}
+}
+
+func (h *hostMeasured) captureMemory(destination MeasureDestination) error {
+	f, err := os.Open(filepath.Join(h.procPath, "meminfo"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var mname string
+		switch fields[0] {
+		case "MemTotal:":
+			mname = "TotalMemory"
+		case "MemFree:":
+			mname = "FreeMemory"
+		default:
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("meminfo %s: %w", fields[0], err)
+		}
+		GaugeMeasure{float64(kb * 1024), mname}.save(destination)
+	}
+	return scanner.Err()
+}
+
+func (h *hostMeasured) captureCPU(destination MeasureDestination) error {
+	f, err := os.Open(filepath.Join(h.procPath, "stat"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	current := make(map[int]cpuTimes)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") || fields[0] == "cpu" {
+			continue
+		}
+		core, err := strconv.Atoi(strings.TrimPrefix(fields[0], "cpu"))
+		if err != nil {
+			continue
+		}
+		var times cpuTimes
+		for i, field := range fields[1:] {
+			// guest and guest_nice are already counted in user and nice
+			if i >= 8 {
+				break
+			}
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return fmt.Errorf("stat %s: %w", fields[0], err)
+			}
+			times.total += v
+			// idle and iowait
+			if i == 3 || i == 4 {
+				times.idle += v
+			}
+		}
+		current[core] = times
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for core, times := range current {
+		prev := h.previous[core]
+		total := delta(times.total, prev.total)
+		busy := total - delta(times.idle, prev.idle)
+		utilization := 0.0
+		if total > 0 && busy > 0 {
+			utilization = 100 * float64(busy) / float64(total)
+		}
+		GaugeMeasure{utilization, fmt.Sprintf("CPUutilization%d", core+1)}.save(destination)
+	}
+	h.previous = current
+	return nil
+}
+
+// delta is signed and clamped at zero: the kernel lets iowait go backwards
+// and a core coming back online starts counting anew.
+func delta(current, previous uint64) int64 {
+	if d := int64(current) - int64(previous); d > 0 {
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeProcFiles(t *testing.T, dir, stat string) {
+	meminfo := "MemTotal:        2048 kB\nMemFree:         1024 kB\nMemAvailable:    1536 kB\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "meminfo"), []byte(meminfo), 0666))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0666))
+}
+
+func TestHostMeasured(t *testing.T) {
+	dir := t.TempDir()
+	h := &hostMeasured{procPath: dir}
+
+	writeProcFiles(t, dir, "cpu  200 0 0 200 0 0 0 0 0 0\ncpu0 100 0 0 100 0 0 0 0 0 0\ncpu1 100 0 0 100 0 0 0 0 0 0\n")
+	h.captureMetrics(&measuresBuffer{})
+
+	writeProcFiles(t, dir, "cpu  350 0 0 250 0 0 0 0 0 0\ncpu0 175 0 0 125 0 0 0 0 0 0\ncpu1 175 0 0 125 0 0 0 0 0 0\n")
+	mb := &measuresBuffer{}
+	h.captureMetrics(mb)
+
+	got := make(map[string]float64)
+	for _, m := range mb.buffer {
+		got[m.name()] = m.(GaugeMeasure).value
+	}
+	assert.Equal(t, map[string]float64{
+		"TotalMemory":     2048 * 1024,
+		"FreeMemory":      1024 * 1024,
+		"CPUutilization1": 75,
+		"CPUutilization2": 75,
+	}, got)
+}
+
+func TestHostMeasuredCPUDeltas(t *testing.T) {
+	dir := t.TempDir()
+	h := &hostMeasured{procPath: dir}
+
+	writeProcFiles(t, dir, "cpu0 100 0 0 100 50 0 0 0 0 0\ncpu1 100 0 0 100 0 0 0 0 0 0\n")
+	h.captureMetrics(&measuresBuffer{})
+
+	// cpu0: iowait went backwards, cpu1: guest time is part of user time already
+	writeProcFiles(t, dir, "cpu0 200 0 0 100 40 0 0 0 0 0\ncpu1 200 0 0 200 0 0 0 0 100 100\n")
+	mb := &measuresBuffer{}
+	h.captureMetrics(mb)
+
+	got := make(map[string]float64)
+	for _, m := range mb.buffer {
+		got[m.name()] = m.(GaugeMeasure).value
+	}
+	assert.Equal(t, 100.0, got["CPUutilization1"])
+	assert.Equal(t, 50.0, got["CPUutilization2"])
+}
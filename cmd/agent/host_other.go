@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+type hostMeasured struct{}
+
+func newHostMeasured() *hostMeasured {
+	return &hostMeasured{}
+}
+
+func (h *hostMeasured) captureMetrics(destination MeasureDestination) {
+}
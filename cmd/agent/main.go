@@ -1,19 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rsa"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/javaman/go-metrics/internal/config"
+	"github.com/javaman/go-metrics/internal/encryption"
+	"github.com/javaman/go-metrics/internal/hash"
 	"github.com/javaman/go-metrics/internal/model"
+	pb "github.com/javaman/go-metrics/internal/proto"
+	"github.com/javaman/go-metrics/internal/retry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 type MeasureDestination interface {
 	saveCounter(m Measure, value int64)
 	saveGauge(m Measure, value float64)
+	saveHistogram(m Measure, value model.Histogram)
 }
 
 type Measure interface {
@@ -31,6 +52,11 @@ type CounterMeasure struct {
 	mname string
 }
 
+type HistogramMeasure struct {
+	value model.Histogram
+	mname string
+}
+
 func (m GaugeMeasure) name() string {
 	return m.mname
 }
@@ -47,22 +73,49 @@ func (m CounterMeasure) save(to MeasureDestination) {
 	to.saveCounter(m, m.value)
 }
 
+func (m HistogramMeasure) name() string {
+	return m.mname
+}
+
+func (m HistogramMeasure) save(to MeasureDestination) {
+	to.saveHistogram(m, m.value)
+}
+
 type Measured interface {
 	captureMetrics(to MeasureDestination)
 }
 
 type measuresBuffer struct {
+	mu     sync.Mutex
 	buffer []Measure
 }
 
 func (mb *measuresBuffer) saveCounter(m Measure, value int64) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
 	mb.buffer = append(mb.buffer, m)
 }
 
 func (mb *measuresBuffer) saveGauge(m Measure, value float64) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.buffer = append(mb.buffer, m)
+}
+
+func (mb *measuresBuffer) saveHistogram(m Measure, value model.Histogram) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
 	mb.buffer = append(mb.buffer, m)
 }
 
+func (mb *measuresBuffer) drain() []Measure {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	result := mb.buffer
+	mb.buffer = nil
+	return result
+}
+
 type defaultMeasured struct {
 	pollCount int64
 }
@@ -106,34 +159,156 @@ func (d *defaultMeasured) captureMetrics(destination MeasureDestination) {
 
 }
 
+type metricsBatch []model.Metrics
+
+func (b *metricsBatch) saveCounter(m Measure, v int64) {
+	*b = append(*b, model.Metrics{ID: m.name(), MType: "counter", Delta: &v})
+}
+
+func (b *metricsBatch) saveGauge(m Measure, v float64) {
+	*b = append(*b, model.Metrics{ID: m.name(), MType: "gauge", Value: &v})
+}
+
+func (b *metricsBatch) saveHistogram(m Measure, v model.Histogram) {
+	*b = append(*b, model.Metrics{ID: m.name(), MType: "histogram", Histogram: &v})
+}
+
+type batchSender interface {
+	sendBatch(measures []Measure) error
+}
+
 type measuresServer struct {
 	*resty.Client
+	key         string
+	retryDelays []time.Duration
+	labels      map[string]string
+	publicKey   *rsa.PublicKey
+	realIP      string
 }
 
-func (s *measuresServer) saveCounter(m Measure, v int64) {
-	j := &model.Metrics{ID: m.name(), MType: "counter", Delta: &v}
-	encoded, _ := json.Marshal(*j)
-	s.R().
-		SetHeader("Content-Type", "application/json").
-		SetBody(string(encoded[:])).
-		Post("/")
+type statusError struct {
+	path   string
+	status string
+	code   int
 }
 
-func (s *measuresServer) saveGauge(m Measure, v float64) {
-	j := &model.Metrics{ID: m.name(), MType: "gauge", Value: &v}
-	encoded, _ := json.Marshal(j)
-	s.R().
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.path, e.status)
+}
+
+// isRetriable accepts only failures of requests the server did not apply, repeating any other
+// would count the counters twice: the connection was never made, or the server answered 503.
+func isRetriable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code == http.StatusServiceUnavailable
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// outboundIP returns the local address used to reach the server; no packets are sent.
+func outboundIP(address string) (net.IP, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func (s *measuresServer) post(path string, body any) (*resty.Response, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := compress(encoded)
+	if err != nil {
+		return nil, err
+	}
+	req := s.R().
 		SetHeader("Content-Type", "application/json").
-		SetBody(string(encoded[:])).
-		Post("/")
+		SetHeader("Content-Encoding", "gzip")
+	if s.realIP != "" {
+		req.SetHeader("X-Real-IP", s.realIP)
+	}
+	if s.publicKey != nil {
+		encrypted, err := encryption.Encrypt(s.publicKey, compressed)
+		if err != nil {
+			return nil, err
+		}
+		req.SetHeader(encryption.HeaderEncryption, encryption.Scheme).SetBody(encrypted)
+	} else {
+		req.SetBody(compressed)
+	}
+	if s.key != "" {
+		req.SetHeader(hash.HeaderHashSHA256, hash.Sign(s.key, encoded))
+	}
+	var resp *resty.Response
+	err = retry.Do(context.Background(), s.retryDelays, isRetriable, func() error {
+		resp, err = req.Post(path)
+		if err != nil {
+			return err
+		}
+		if resp.IsError() && resp.StatusCode() != http.StatusNotFound {
+			return &statusError{path, resp.Status(), resp.StatusCode()}
+		}
+		return nil
+	})
+	return resp, err
 }
 
-func gcd(a, b int) int {
-	for b != 0 {
-		a, b = b, a%b
+func (s *measuresServer) sendEach(batch metricsBatch) error {
+	var errs []error
+	for _, m := range batch {
+		resp, err := s.post("/update/", m)
+		if err == nil && resp.StatusCode() == http.StatusNotFound {
+			err = &statusError{"/update/", resp.Status(), resp.StatusCode()}
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
 	}
+	return errors.Join(errs...)
+}
+
+func (s *measuresServer) sendBatch(measures []Measure) error {
+	if len(measures) == 0 {
+		return nil
+	}
+	batch := newMetricsBatch(measures, s.labels)
 
-	return a
+	resp, err := s.post("/updates/", batch)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() == http.StatusNotFound {
+		return s.sendEach(batch)
+	}
+	return nil
+}
+
+func newMetricsBatch(measures []Measure, labels map[string]string) metricsBatch {
+	batch := make(metricsBatch, 0, len(measures))
+	send(measures, &batch)
+	if len(labels) > 0 {
+		for i := range batch {
+			batch[i].Labels = labels
+		}
+	}
+	return batch
 }
 
 func send(measures []Measure, destination MeasureDestination) {
@@ -142,62 +317,187 @@ func send(measures []Measure, destination MeasureDestination) {
 	}
 }
 
-type Worker interface {
-	run()
+type pipeline struct {
+	pollInterval   time.Duration
+	reportInterval time.Duration
+	rateLimit      int
+	sources        []Measured
+	buffer         *measuresBuffer
+	send           func([]Measure)
+}
+
+func (p *pipeline) poll(ctx context.Context, source Measured) {
+	ticker := time.NewTicker(p.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			source.captureMetrics(p.buffer)
+		}
+	}
+}
+
+func (p *pipeline) report(ctx context.Context, jobs chan<- []Measure) {
+	ticker := time.NewTicker(p.reportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			batch := p.buffer.drain()
+			if len(batch) == 0 {
+				continue
+			}
+			select {
+			case jobs <- batch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
 }
 
-type defaultWorker struct {
-	pollInterval   int
-	reportInterval int
-	pollFunction   func()
-	reportFunction func()
-	advance        func() bool
+func (p *pipeline) work(jobs <-chan []Measure) {
+	for batch := range jobs {
+		p.send(batch)
+	}
+}
+
+func (p *pipeline) run(ctx context.Context) {
+	jobs := make(chan []Measure)
+
+	workersCount := p.rateLimit
+	if workersCount < 1 {
+		workersCount = 1
+	}
+	var workers sync.WaitGroup
+	for i := 0; i < workersCount; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			p.work(jobs)
+		}()
+	}
+
+	var pollers sync.WaitGroup
+	for _, source := range p.sources {
+		pollers.Add(1)
+		go func(source Measured) {
+			defer pollers.Done()
+			p.poll(ctx, source)
+		}(source)
+	}
+
+	p.report(ctx, jobs)
+
+	pollers.Wait()
+	if batch := p.buffer.drain(); len(batch) > 0 {
+		jobs <- batch
+	}
+	close(jobs)
+	workers.Wait()
 }
 
-func (w *defaultWorker) run() {
-	intervalsGcd := gcd(w.pollInterval, w.reportInterval)
-	var timeSpent int
-	for w.advance() {
-		time.Sleep(time.Duration(intervalsGcd) * time.Second)
-		timeSpent += intervalsGcd
-		if timeSpent%w.pollInterval == 0 {
-			w.pollFunction()
+func defaultLabels(conf *config.AgentConfiguration) (map[string]string, error) {
+	labels := make(map[string]string)
+	if conf.InstanceID != "" {
+		labels["instance"] = conf.InstanceID
+	}
+	if conf.HostLabel {
+		if host, err := os.Hostname(); err == nil {
+			labels["host"] = host
 		}
-		if timeSpent%w.reportInterval == 0 {
-			w.reportFunction()
+	}
+	for k, v := range conf.Labels {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
 		}
-		if timeSpent%w.reportInterval == 0 && timeSpent%w.pollInterval == 0 {
-			timeSpent = 0
+	}
+	for k := range labels {
+		if !model.ValidLabelName(k) {
+			return nil, fmt.Errorf("invalid label name %q", k)
 		}
 	}
+	return labels, nil
 }
 
 func main() {
 	conf := config.ConfigureAgent()
 
-	defaultMeasured := &defaultMeasured{}
-	measuresBuffer := &measuresBuffer{}
-	measuresServer := &measuresServer{
-		resty.New(),
+	labels, err := defaultLabels(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var publicKey *rsa.PublicKey
+	if conf.CryptoKey != "" {
+		publicKey, err = encryption.LoadPublicKey(conf.CryptoKey)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	measuresServer.SetBaseURL("http://" + conf.Address + "/update")
 
-	dw := &defaultWorker{
-		conf.PollInterval,
-		conf.ReportInterval,
-		func() { defaultMeasured.captureMetrics(measuresBuffer) },
-		func() {
-			metricsToSend := make([]Measure, len(measuresBuffer.buffer))
-			copy(metricsToSend, measuresBuffer.buffer)
+	address := conf.Address
+	if conf.GRPCAddress != "" {
+		address = conf.GRPCAddress
+	}
+	var realIP string
+	if ip, err := outboundIP(address); err == nil {
+		realIP = ip.String()
+	} else {
+		log.Println(err)
+	}
 
-			send(metricsToSend, measuresServer)
-			measuresBuffer.buffer = measuresBuffer.buffer[:0]
-		},
-		func() bool {
-			return true
+	var sender batchSender
+	if conf.GRPCAddress != "" {
+		creds := insecure.NewCredentials()
+		if publicKey != nil {
+			creds = credentials.NewTLS(encryption.PinnedTLSConfig(publicKey))
+		}
+		conn, err := grpc.Dial(conf.GRPCAddress, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+		sender = &grpcSender{pb.NewMetricsClient(conn), conf.Key, conf.RetryDelays, labels, realIP}
+	} else {
+		measuresServer := &measuresServer{
+			resty.New(),
+			conf.Key,
+			conf.RetryDelays,
+			labels,
+			publicKey,
+			realIP,
+		}
+		measuresServer.SetBaseURL("http://" + conf.Address)
+		sender = measuresServer
+	}
+
+	sources, err := newCollectorRegistry().build(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p := &pipeline{
+		pollInterval:   time.Duration(conf.PollInterval) * time.Second,
+		reportInterval: time.Duration(conf.ReportInterval) * time.Second,
+		rateLimit:      conf.RateLimit,
+		sources:        sources,
+		buffer:         &measuresBuffer{},
+		send: func(measures []Measure) {
+			if err := sender.sendBatch(measures); err != nil {
+				log.Println(err)
+			}
 		},
 	}
 
-	dw.run()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	defer stop()
 
+	p.run(ctx)
 }
@@ -1,8 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/go-resty/resty/v2"
+	"github.com/javaman/go-metrics/internal/config"
+	"github.com/javaman/go-metrics/internal/encryption"
+	"github.com/javaman/go-metrics/internal/hash"
+	"github.com/javaman/go-metrics/internal/model"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -67,23 +87,278 @@ func TestDefaultMeasured(t *testing.T) {
 	assert.Empty(t, expectedMetrics)
 }
 
-func TestDefaultWorker(t *testing.T) {
-	callsCount := map[string]int{
-		"one": 2,
-		"two": 1,
+type countingMeasured struct {
+	calls atomic.Int64
+}
+
+func (c *countingMeasured) captureMetrics(destination MeasureDestination) {
+	c.calls.Add(1)
+	GaugeMeasure{1, "Test"}.save(destination)
+}
+
+func TestPipeline(t *testing.T) {
+	source := &countingMeasured{}
+	var inFlight, maxInFlight, sent atomic.Int64
+	p := &pipeline{
+		pollInterval:   time.Millisecond,
+		reportInterval: 5 * time.Millisecond,
+		rateLimit:      2,
+		sources:        []Measured{source},
+		buffer:         &measuresBuffer{},
+		send: func(measures []Measure) {
+			n := inFlight.Add(1)
+			for {
+				m := maxInFlight.Load()
+				if n <= m || maxInFlight.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			sent.Add(int64(len(measures)))
+			inFlight.Add(-1)
+		},
 	}
-	f1 := func() { callsCount["one"] = callsCount["one"] - 1 }
-	f2 := func() { callsCount["two"] = callsCount["two"] - 1 }
-	p := func() bool { return callsCount["two"] > 0 }
-	dw := &defaultWorker{
-		1,
-		2,
-		f1,
-		f2,
-		p,
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	p.run(ctx)
+
+	assert.Positive(t, source.calls.Load())
+	assert.Positive(t, sent.Load())
+	assert.LessOrEqual(t, maxInFlight.Load(), int64(2))
+	assert.Equal(t, int64(0), inFlight.Load())
+}
+
+func TestPipelineFlushesOnShutdown(t *testing.T) {
+	var sent atomic.Int64
+	p := &pipeline{
+		pollInterval:   time.Millisecond,
+		reportInterval: time.Hour,
+		rateLimit:      1,
+		sources:        []Measured{&countingMeasured{}},
+		buffer:         &measuresBuffer{},
+		send: func(measures []Measure) {
+			sent.Add(int64(len(measures)))
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	p.run(ctx)
+
+	assert.Positive(t, sent.Load())
+	assert.Empty(t, p.buffer.drain())
+}
+
+func decodeGzipJSON(t *testing.T, r *http.Request, v any) {
+	assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+	zr, err := gzip.NewReader(r.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, json.NewDecoder(zr).Decode(v))
+}
+
+func TestSendBatch(t *testing.T) {
+	var received []model.Metrics
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/updates/", r.URL.Path)
+		decodeGzipJSON(t, r, &received)
+	}))
+	defer ts.Close()
+
+	s := &measuresServer{Client: resty.New().SetBaseURL(ts.URL)}
+	err := s.sendBatch([]Measure{GaugeMeasure{2.72, "e"}, CounterMeasure{42, "c"}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(received))
+	assert.Equal(t, "e", received[0].ID)
+	assert.Equal(t, 2.72, *received[0].Value)
+	assert.Equal(t, "c", received[1].ID)
+	assert.Equal(t, int64(42), *received[1].Delta)
+}
+
+func TestSendBatchLabels(t *testing.T) {
+	var received []model.Metrics
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decodeGzipJSON(t, r, &received)
+	}))
+	defer ts.Close()
+
+	labels := map[string]string{"host": "h1", "instance": "i1"}
+	s := &measuresServer{Client: resty.New().SetBaseURL(ts.URL), labels: labels}
+	assert.NoError(t, s.sendBatch([]Measure{GaugeMeasure{2.72, "e"}, CounterMeasure{42, "c"}}))
+
+	assert.Equal(t, 2, len(received))
+	for _, m := range received {
+		assert.Equal(t, labels, m.Labels)
 	}
-	dw.run()
-	assert.Equal(t, 0, callsCount["one"])
-	assert.Equal(t, 0, callsCount["two"])
+}
+
+func TestDefaultLabels(t *testing.T) {
+	labels, err := defaultLabels(&config.AgentConfiguration{
+		InstanceID: "i1",
+		HostLabel:  true,
+		Labels:     map[string]string{"service": "api", "host": ""},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"instance": "i1", "service": "api"}, labels)
+
+	labels, err = defaultLabels(&config.AgentConfiguration{})
+	assert.NoError(t, err)
+	assert.Empty(t, labels)
+
+	labels, err = defaultLabels(&config.AgentConfiguration{HostLabel: true})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, labels["host"])
+
+	_, err = defaultLabels(&config.AgentConfiguration{Labels: map[string]string{"bad-name": "x"}})
+	assert.Error(t, err)
+}
+
+func TestSendBatchHistogram(t *testing.T) {
+	var received []model.Metrics
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decodeGzipJSON(t, r, &received)
+	}))
+	defer ts.Close()
+
+	h := model.NewHistogram([]float64{0.1})
+	h.Observe(0.05)
+	s := &measuresServer{Client: resty.New().SetBaseURL(ts.URL)}
+	assert.NoError(t, s.sendBatch([]Measure{HistogramMeasure{h, "GCPause"}}))
+
+	assert.Equal(t, 1, len(received))
+	assert.Equal(t, "histogram", received[0].MType)
+	assert.Equal(t, h, *received[0].Histogram)
+}
+
+func TestSendBatchFallback(t *testing.T) {
+	var received []model.Metrics
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/updates/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var m model.Metrics
+		decodeGzipJSON(t, r, &m)
+		received = append(received, m)
+	}))
+	defer ts.Close()
+
+	s := &measuresServer{Client: resty.New().SetBaseURL(ts.URL)}
+	err := s.sendBatch([]Measure{GaugeMeasure{2.72, "e"}, CounterMeasure{42, "c"}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(received))
+}
+
+func TestSendBatchError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	s := &measuresServer{Client: resty.New().SetBaseURL(ts.URL)}
+	assert.Error(t, s.sendBatch([]Measure{GaugeMeasure{2.72, "e"}}))
+}
+
+func TestSendBatchSigned(t *testing.T) {
+	var signature string
+	var body []model.Metrics
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(hash.HeaderHashSHA256)
+		decodeGzipJSON(t, r, &body)
+	}))
+	defer ts.Close()
+
+	s := &measuresServer{Client: resty.New().SetBaseURL(ts.URL), key: "secret"}
+	assert.NoError(t, s.sendBatch([]Measure{GaugeMeasure{2.72, "e"}}))
+
+	encoded, _ := json.Marshal(body)
+	assert.True(t, hash.Verify("secret", encoded, signature))
+}
+
+func TestSendBatchEncrypted(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	var body []model.Metrics
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, encryption.Scheme, r.Header.Get(encryption.HeaderEncryption))
+		encrypted, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		compressed, err := encryption.Decrypt(key, encrypted)
+		assert.NoError(t, err)
+		r.Body = io.NopCloser(bytes.NewReader(compressed))
+		decodeGzipJSON(t, r, &body)
+	}))
+	defer ts.Close()
+
+	s := &measuresServer{Client: resty.New().SetBaseURL(ts.URL), publicKey: &key.PublicKey}
+	assert.NoError(t, s.sendBatch([]Measure{GaugeMeasure{2.72, "e"}}))
+
+	assert.Equal(t, 1, len(body))
+	assert.Equal(t, "e", body[0].ID)
+	assert.Equal(t, 2.72, *body[0].Value)
+}
+
+func TestSendBatchRealIP(t *testing.T) {
+	var realIP string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		realIP = r.Header.Get("X-Real-IP")
+	}))
+	defer ts.Close()
+
+	ip, err := outboundIP(ts.Listener.Addr().String())
+	assert.NoError(t, err)
+	assert.True(t, ip.IsLoopback())
+
+	s := &measuresServer{Client: resty.New().SetBaseURL(ts.URL), realIP: ip.String()}
+	assert.NoError(t, s.sendBatch([]Measure{GaugeMeasure{2.72, "e"}}))
+	assert.Equal(t, ip.String(), realIP)
+}
+
+func TestSendBatchRetry(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	s := &measuresServer{
+		Client:      resty.New().SetBaseURL(ts.URL),
+		retryDelays: []time.Duration{time.Millisecond, time.Millisecond},
+	}
+	assert.NoError(t, s.sendBatch([]Measure{GaugeMeasure{2.72, "e"}}))
+	assert.Equal(t, 3, calls)
+}
+
+func TestSendBatchNoRetryOnClientError(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	s := &measuresServer{
+		Client:      resty.New().SetBaseURL(ts.URL),
+		retryDelays: []time.Duration{time.Millisecond, time.Millisecond},
+	}
+	assert.Error(t, s.sendBatch([]Measure{GaugeMeasure{2.72, "e"}}))
+	assert.Equal(t, 1, calls)
+}
 
+func TestIsRetriable(t *testing.T) {
+	s := &measuresServer{Client: resty.New().SetBaseURL("http://127.0.0.1:1")}
+	_, err := s.post("/updates/", nil)
+	assert.True(t, isRetriable(err))
+	assert.True(t, isRetriable(&statusError{"/updates/", "503 Service Unavailable", http.StatusServiceUnavailable}))
+	assert.False(t, isRetriable(&statusError{"/updates/", "500 Internal Server Error", http.StatusInternalServerError}))
+	assert.False(t, isRetriable(&statusError{"/updates/", "502 Bad Gateway", http.StatusBadGateway}))
+	assert.False(t, isRetriable(&statusError{"/updates/", "400 Bad Request", http.StatusBadRequest}))
+	assert.False(t, isRetriable(fmt.Errorf("post: %w", syscall.ECONNRESET)))
+	assert.False(t, isRetriable(&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}))
 }
@@ -0,0 +1,97 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const clockTicks = 100
+
+type processMeasured struct {
+	procPath string
+}
+
+func newProcessMeasured() *processMeasured {
+	return &processMeasured{filepath.Join("/proc", "self")}
+}
+
+func (p *processMeasured) captureMetrics(destination MeasureDestination) {
+	if err := p.captureStatus(destination); err != nil {
+		log.Println(err)
+	}
+	if err := p.captureCPU(destination); err != nil {
+		log.Println(err)
+	}
+	if fds, err := os.ReadDir(filepath.Join(p.procPath, "fd")); err == nil {
+		GaugeMeasure{float64(len(fds)), "ProcessOpenFDs"}.save(destination)
+	} else {
+		log.Println(err)
+	}
+}
+
+func (p *processMeasured) captureStatus(destination MeasureDestination) error {
+	f, err := os.Open(filepath.Join(p.procPath, "status"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var mname string
+		multiplier := uint64(1)
+		switch fields[0] {
+		case "VmRSS:":
+			mname, multiplier = "ProcessResidentMemory", 1024
+		case "VmSize:":
+			mname, multiplier = "ProcessVirtualMemory", 1024
+		case "Threads:":
+			mname = "ProcessThreads"
+		default:
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("status %s: %w", fields[0], err)
+		}
+		GaugeMeasure{float64(v * multiplier), mname}.save(destination)
+	}
+	return scanner.Err()
+}
+
+func (p *processMeasured) captureCPU(destination MeasureDestination) error {
+	data, err := os.ReadFile(filepath.Join(p.procPath, "stat"))
+	if err != nil {
+		return err
+	}
+	// the command name may contain spaces, so fields are counted after its closing parenthesis
+	idx := strings.LastIndexByte(string(data), ')')
+	if idx < 0 {
+		return fmt.Errorf("unexpected stat format")
+	}
+	fields := strings.Fields(string(data[idx+1:]))
+	if len(fields) < 13 {
+		return fmt.Errorf("unexpected stat format")
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return err
+	}
+	GaugeMeasure{float64(utime+stime) / clockTicks, "ProcessCPUSeconds"}.save(destination)
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessMeasured(t *testing.T) {
+	mb := &measuresBuffer{}
+	newProcessMeasured().captureMetrics(mb)
+
+	names := namesOf(mb.buffer)
+	for _, name := range []string{"ProcessResidentMemory", "ProcessVirtualMemory", "ProcessThreads", "ProcessCPUSeconds", "ProcessOpenFDs"} {
+		assert.True(t, names[name], name)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+type processMeasured struct{}
+
+func newProcessMeasured() *processMeasured {
+	return &processMeasured{}
+}
+
+func (p *processMeasured) captureMetrics(destination MeasureDestination) {
+}
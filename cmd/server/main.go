@@ -1,32 +1,243 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/javaman/go-metrics/internal/audit"
 	"github.com/javaman/go-metrics/internal/config"
+	"github.com/javaman/go-metrics/internal/encryption"
+	"github.com/javaman/go-metrics/internal/grpcserver"
 	"github.com/javaman/go-metrics/internal/handlers"
+	"github.com/javaman/go-metrics/internal/middleware"
+	"github.com/javaman/go-metrics/internal/notifier"
 	"github.com/javaman/go-metrics/internal/repository"
 	"github.com/javaman/go-metrics/internal/services"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
+const shutdownTimeout = 10 * time.Second
+
+func evictInterval(ttl time.Duration) time.Duration {
+	if interval := ttl / 2; interval < time.Minute {
+		return interval
+	}
+	return time.Minute
+}
+
+func stopGRPC(s *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		s.Stop()
+	}
+}
+
 func main() {
 	cfg := config.ConfigureServer()
+	if err := run(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(cfg *config.ServerConfiguration) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	defer stop()
 
 	var storage repository.Storage
+	var flushed <-chan struct{}
 
-	if cfg.Restore {
-		storage = repository.NewInMemoryStorageFromFile(cfg.FileStoragePath)
+	if cfg.DatabaseDSN != "" {
+		pgStorage, err := repository.NewPostgresStorage(ctx, cfg.DatabaseDSN)
+		if err != nil {
+			return err
+		}
+		defer pgStorage.Close()
+		storage = repository.MakeStorageRetrying(pgStorage, cfg.RetryDelays)
 	} else {
-		storage = repository.NewInMemoryStorage()
+		var err error
+		if cfg.Restore {
+			storage, err = repository.NewInMemoryStorageFromFile(cfg.FileStoragePath)
+			if err != nil {
+				return err
+			}
+		} else {
+			storage = repository.NewInMemoryStorage()
+		}
+
+		if cfg.StoreInterval > 0 {
+			storage, err = repository.MakeStorageWithWAL(storage, cfg.FileStoragePath)
+			if err != nil {
+				return err
+			}
+			flushed = services.FlushStorageInBackground(ctx, storage, cfg.FileStoragePath, cfg.StoreInterval)
+			storage = repository.MakeStorageCheckingFile(storage, cfg.FileStoragePath)
+		} else {
+			storage, err = repository.MakeStorageFlushedOnEachCall(storage, cfg.FileStoragePath)
+			if err != nil {
+				return err
+			}
+		}
+		defer func() {
+			if err := storage.WriteToFile(cfg.FileStoragePath); err != nil {
+				log.Println(err)
+			}
+		}()
 	}
 
-	if cfg.StoreInterval > 0 {
-		services.FlushStorageInBackground(storage, cfg.FileStoragePath, cfg.StoreInterval)
-	} else {
-		storage = repository.MakeStorageFlushedOnEachCall(storage, cfg.FileStoragePath)
+	if cfg.HistorySize > 0 {
+		storage = repository.MakeStorageWithHistory(storage, cfg.HistorySize, cfg.HistoryRetention)
+	}
+
+	storage, err := repository.MakeStorageWithTimestamps(storage)
+	if err != nil {
+		return err
+	}
+	if cfg.MetricTTL > 0 && cfg.EvictStale {
+		evicted := services.EvictStaleInBackground(ctx, storage, cfg.MetricTTL, evictInterval(cfg.MetricTTL))
+		defer func() { stop(); <-evicted }()
+	}
+
+	hub := services.NewHub()
+	service := services.MakeServiceStreaming(services.NewMetricsServiceWithTTL(storage, cfg.MetricTTL), hub)
+
+	var alerts *services.AlertEngine
+	if cfg.AlertRules != "" {
+		rules, err := services.LoadAlertRules(cfg.AlertRules)
+		if err != nil {
+			return err
+		}
+		alerts, err = services.NewAlertEngine(service, rules, cfg.AlertStateFile)
+		if err != nil {
+			return err
+		}
+		evaluated := services.EvaluateAlertsInBackground(ctx, alerts, cfg.AlertInterval)
+		defer func() { stop(); <-evaluated }()
 	}
 
-	service := services.NewMetricsService(storage)
+	var notify *notifier.Notifier
+	if alerts != nil && len(cfg.AlertWebhooks) > 0 {
+		notify = notifier.New(cfg.AlertWebhooks, cfg.RetryDelays, cfg.AlertRepeat)
+		alerts.Subscribe(notify.Notify)
+		notified := notify.RunInBackground(ctx, cfg.AlertGroupWait)
+		defer func() { stop(); <-notified }()
+	}
+
+	var observers []audit.Observer
+	if cfg.AuditFile != "" {
+		fileObserver, err := audit.NewFileObserver(cfg.AuditFile)
+		if err != nil {
+			return err
+		}
+		defer fileObserver.Close()
+		observers = append(observers, fileObserver)
+	}
+	if cfg.AuditURL != "" {
+		observers = append(observers, audit.NewURLObserver(cfg.AuditURL))
+	}
+	var auditor *audit.Auditor
+	if len(observers) > 0 {
+		auditor = audit.New(observers...)
+		// the auditor outlives the servers: requests still in flight during shutdown publish events too
+		auditCtx, stopAudit := context.WithCancel(context.Background())
+		audited := auditor.Run(auditCtx)
+		defer func() { stopAudit(); <-audited }()
+	}
+
+	var middlewares []echo.MiddlewareFunc
+	if auditor != nil {
+		middlewares = append(middlewares, middleware.Audit(auditor))
+	}
+	var grpcOpts []grpc.ServerOption
+	if cfg.TrustedSubnet != "" {
+		_, subnet, err := net.ParseCIDR(cfg.TrustedSubnet)
+		if err != nil {
+			return err
+		}
+		middlewares = append(middlewares, middleware.TrustedSubnet(subnet))
+		grpcOpts = append(grpcOpts, grpcserver.TrustedSubnet(subnet)...)
+	}
+	if cfg.Key != "" {
+		middlewares = append(middlewares, middleware.HashSHA256(cfg.Key))
+	}
+
+	e := handlers.New(service, middlewares...)
+	if cfg.CryptoKey != "" {
+		privateKey, err := encryption.LoadPrivateKey(cfg.CryptoKey)
+		if err != nil {
+			return err
+		}
+		e.Pre(middleware.Decrypt(privateKey))
+		cert, err := encryption.SelfSignedCertificate(privateKey)
+		if err != nil {
+			return err
+		}
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	}
+	e.GET("/stream", handlers.Stream(ctx, hub, cfg.StreamHeartbeat))
+	e.GET("/ws", handlers.WebSocket(ctx, hub, cfg.StreamHeartbeat))
+	if alerts != nil {
+		e.GET("/alerts", handlers.Alerts(alerts))
+	}
+	if notify != nil {
+		e.GET("/silences", handlers.Silences(notify))
+		e.POST("/silences", handlers.CreateSilence(notify))
+		e.DELETE("/silences/:id", handlers.ExpireSilence(notify))
+	}
+
+	var grpcServer *grpc.Server
+	var listener net.Listener
+	if cfg.GRPCAddress != "" {
+		listener, err = net.Listen("tcp", cfg.GRPCAddress)
+		if err != nil {
+			return err
+		}
+		grpcServer = grpcserver.New(service, cfg.Key, auditor, grpcOpts...)
+	}
 
-	e := handlers.New(service)
+	serverErr := make(chan error, 2)
+	go func() {
+		serverErr <- e.Start(cfg.Address)
+	}()
+	if grpcServer != nil {
+		go func() {
+			serverErr <- grpcServer.Serve(listener)
+		}()
+	}
 
-	e.Logger.Fatal(e.Start(cfg.Address))
+	select {
+	case err = <-serverErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err = e.Shutdown(shutdownCtx)
+	}
+	if grpcServer != nil {
+		stopGRPC(grpcServer)
+	}
+
+	stop()
+	if flushed != nil {
+		<-flushed
+	}
+	return err
 }
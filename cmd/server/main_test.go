@@ -1,15 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/javaman/go-metrics/internal/audit"
+	"github.com/javaman/go-metrics/internal/config"
 	"github.com/javaman/go-metrics/internal/handlers"
+	"github.com/javaman/go-metrics/internal/hash"
+	"github.com/javaman/go-metrics/internal/middleware"
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/javaman/go-metrics/internal/notifier"
 	"github.com/javaman/go-metrics/internal/repository"
 	"github.com/javaman/go-metrics/internal/services"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
 )
 
 func TestOne(t *testing.T) {
@@ -148,3 +166,643 @@ func TestOne(t *testing.T) {
 		assert.Equal(t, test.expectedStatus, rec.Code)
 	}
 }
+
+func TestUpdates(t *testing.T) {
+	storage := repository.NewInMemoryStorage()
+	storage.SaveCounter("counter1", 42)
+	service := services.NewMetricsService(storage)
+
+	testData := []struct {
+		body           string
+		expectedStatus int
+	}{
+		{`[{"id":"counter1","type":"counter","delta":1},{"id":"g1","type":"gauge","value":3.14}]`, http.StatusOK},
+		{`[{"id":"counter1","type":"counter","delta":1},{"id":"g2","type":"gauge"}]`, http.StatusBadRequest},
+		{`[{"id":"","type":"gauge","value":1}]`, http.StatusNotFound},
+		{`not a json`, http.StatusBadRequest},
+	}
+
+	e := echo.New()
+
+	for _, test := range testData {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(test.body))
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		handlers.Updates(service)(c)
+		assert.Equal(t, test.expectedStatus, rec.Code)
+	}
+
+	value, _, _ := storage.GetCounter("counter1")
+	assert.Equal(t, int64(43), value)
+	_, found, _ := storage.GetGauge("g2")
+	assert.False(t, found)
+}
+
+func TestPing(t *testing.T) {
+	dir := t.TempDir()
+	testData := []struct {
+		file           string
+		expectedStatus int
+	}{
+		{filepath.Join(dir, "db.json"), http.StatusOK},
+		{filepath.Join(dir, "missing", "db.json"), http.StatusInternalServerError},
+	}
+
+	e := echo.New()
+
+	for _, test := range testData {
+		storage := repository.MakeStorageCheckingFile(repository.NewInMemoryStorage(), test.file)
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		handlers.Ping(services.NewMetricsService(storage))(c)
+		assert.Equal(t, test.expectedStatus, rec.Code)
+	}
+}
+
+func TestUpdatesNotApplied(t *testing.T) {
+	e := handlers.New(services.NewMetricsService(notAppliedStorage{repository.NewInMemoryStorage()}))
+
+	req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(`[{"id":"c","type":"counter","delta":1}]`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+type notAppliedStorage struct {
+	repository.Storage
+}
+
+func (notAppliedStorage) SaveBatch(repository.Batch) (repository.Batch, error) {
+	return repository.Batch{}, syscall.ECONNREFUSED
+}
+
+func TestPrometheus(t *testing.T) {
+	storage := repository.NewInMemoryStorage()
+	storage.SaveGauge("Heap.Alloc", 3.5)
+	storage.SaveGauge("1st", 1)
+	storage.SaveCounter("PollCount", 42)
+	e := handlers.New(services.NewMetricsService(storage))
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "# TYPE Heap_Alloc gauge\nHeap_Alloc 3.5\n"+
+		"# TYPE _1st gauge\n_1st 1\n"+
+		"# TYPE PollCount counter\nPollCount 42\n", rec.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "application/openmetrics-text")
+	assert.Contains(t, rec.Body.String(), "# TYPE PollCount counter\nPollCount_total 42\n")
+	assert.True(t, strings.HasSuffix(rec.Body.String(), "# EOF\n"))
+}
+
+func TestPrometheusCollisions(t *testing.T) {
+	storage := repository.NewInMemoryStorage()
+	storage.SaveGauge("Heap.Alloc", 1)
+	storage.SaveGauge("Heap_Alloc", 2)
+	storage.SaveGauge("PollCount", 3)
+	storage.SaveCounter("PollCount", 4)
+	e := handlers.New(services.NewMetricsService(storage))
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "# TYPE Heap_Alloc gauge\nHeap_Alloc 1\n"+
+		"# TYPE Heap_Alloc_gauge gauge\nHeap_Alloc_gauge 2\n"+
+		"# TYPE PollCount gauge\nPollCount 3\n"+
+		"# TYPE PollCount_counter counter\nPollCount_counter 4\n", rec.Body.String())
+}
+
+// withoutTimestamp drops the update time, which differs between runs, from a metric JSON.
+func withoutTimestamp(t *testing.T, body string) string {
+	var m map[string]any
+	require.NoError(t, json.Unmarshal([]byte(body), &m))
+	delete(m, "timestamp")
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestLabels(t *testing.T) {
+	storage := repository.NewInMemoryStorage()
+	e := handlers.New(services.NewMetricsService(storage))
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(http.MethodPost, "/updates/", `[
+		{"id":"Alloc","type":"gauge","value":1,"labels":{"host":"h1"}},
+		{"id":"Alloc","type":"gauge","value":2,"labels":{"host":"h2"}},
+		{"id":"PollCount","type":"counter","delta":5,"labels":{"host":"h1"}}]`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(http.MethodPost, "/update/counter/PollCount/2?label.host=h1", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(http.MethodPost, "/updates/", `[{"id":"Alloc","type":"gauge","value":1,"labels":{"1st":"h1"}}]`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(http.MethodGet, "/value/gauge/Alloc?label.host=h2", "")
+	assert.Equal(t, "2", rec.Body.String())
+	rec = serve(http.MethodGet, "/value/gauge/Alloc?label.host=h2&_=123", "")
+	assert.Equal(t, "2", rec.Body.String())
+	rec = serve(http.MethodGet, "/value/gauge/Alloc", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = serve(http.MethodPost, "/value/", `{"id":"PollCount","type":"counter","labels":{"host":"h1"}}`)
+	assert.JSONEq(t, `{"id":"PollCount","type":"counter","delta":7,"labels":{"host":"h1"}}`, withoutTimestamp(t, rec.Body.String()))
+	rec = serve(http.MethodGet, "/value/counter/PollCount", "")
+	assert.Equal(t, "7", rec.Body.String())
+	rec = serve(http.MethodPost, "/value/", `{"id":"PollCount","type":"counter"}`)
+	assert.JSONEq(t, `{"id":"PollCount","type":"counter","delta":7,"labels":{"host":"h1"}}`, withoutTimestamp(t, rec.Body.String()))
+
+	rec = serve(http.MethodGet, "/?label.host=h1", "")
+	assert.Contains(t, rec.Body.String(), "Alloc{host=&#34;h1&#34;}")
+	assert.NotContains(t, rec.Body.String(), "h2")
+
+	rec = serve(http.MethodGet, "/metrics", "")
+	assert.Equal(t, "# TYPE Alloc gauge\nAlloc{host=\"h1\"} 1\nAlloc{host=\"h2\"} 2\n"+
+		"# TYPE PollCount counter\nPollCount{host=\"h1\"} 7\n", rec.Body.String())
+}
+
+func TestHistogram(t *testing.T) {
+	storage := repository.NewInMemoryStorage()
+	e := handlers.New(services.NewMetricsService(storage))
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	body := `{"id":"GCPause","type":"histogram","histogram":{"bounds":[0.001,0.01],"counts":[1,2,0],"sum":0.015,"count":3}}`
+	rec := serve(http.MethodPost, "/update/", body)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(http.MethodPost, "/updates/", "["+body+"]")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var saved []model.Metrics
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &saved))
+	assert.Equal(t, model.Histogram{Bounds: []float64{0.001, 0.01}, Counts: []uint64{2, 4, 0}, Sum: 0.03, Count: 6}, *saved[0].Histogram)
+	assert.NotNil(t, saved[0].Timestamp)
+	rec = serve(http.MethodPost, "/update/", `{"id":"GCPause","type":"histogram","histogram":{"bounds":[0.001],"counts":[1],"sum":0,"count":1}}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(http.MethodGet, "/value/histogram/GCPause", "")
+	assert.Equal(t, "le=0.001 2\nle=0.01 6\nle=+Inf 6\nsum 0.03\ncount 6\n", rec.Body.String())
+	rec = serve(http.MethodPost, "/value/", `{"id":"GCPause","type":"histogram"}`)
+	assert.JSONEq(t, `{"id":"GCPause","type":"histogram","histogram":{"bounds":[0.001,0.01],"counts":[2,4,0],"sum":0.03,"count":6}}`, withoutTimestamp(t, rec.Body.String()))
+
+	rec = serve(http.MethodGet, "/metrics", "")
+	assert.Equal(t, "# TYPE GCPause histogram\n"+
+		"GCPause_bucket{le=\"0.001\"} 2\n"+
+		"GCPause_bucket{le=\"0.01\"} 6\n"+
+		"GCPause_bucket{le=\"+Inf\"} 6\n"+
+		"GCPause_sum 0.03\n"+
+		"GCPause_count 6\n", rec.Body.String())
+}
+
+func TestHistory(t *testing.T) {
+	storage := repository.MakeStorageWithHistory(repository.NewInMemoryStorage(), 10, time.Hour)
+	e := handlers.New(services.NewMetricsService(storage))
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		return rec
+	}
+	serve("/update/gauge/HeapAlloc/1?label.host=h1")
+	serve("/update/gauge/HeapAlloc/3?label.host=h1")
+	serve("/update/gauge/HeapAlloc/100?label.host=h2")
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	rec := get("/history/gauge/HeapAlloc?label.host=h1")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var points []model.Point
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &points))
+	assert.Equal(t, 2, len(points))
+	assert.Equal(t, 1.0, points[0].Value)
+	assert.Equal(t, 3.0, points[1].Value)
+
+	from := time.Now().UTC().Add(-time.Minute).Format(time.RFC3339)
+	rec = get("/history/gauge/HeapAlloc?label.host=h1&step=1h&from=" + from)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &points))
+	assert.Equal(t, 1, len(points))
+	assert.Equal(t, 2.0, points[0].Value)
+	assert.Equal(t, 1.0, *points[0].Min)
+	assert.Equal(t, 3.0, *points[0].Max)
+
+	assert.Equal(t, http.StatusNotFound, get("/history/gauge/Missing").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/history/gauge/HeapAlloc?from=yesterday").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/history/histogram/HeapAlloc").Code)
+
+	e = handlers.New(services.NewMetricsService(repository.NewInMemoryStorage()))
+	assert.Equal(t, http.StatusNotImplemented, get("/history/gauge/HeapAlloc").Code)
+}
+
+func TestAlerts(t *testing.T) {
+	service := services.NewMetricsService(repository.NewInMemoryStorage())
+	rules, err := services.ParseAlertRules([]byte(`[
+		{"name": "HighHeap", "metric": "HeapAlloc", "type": "gauge", "condition": ">", "threshold": 100},
+		{"name": "LowHeap", "metric": "HeapAlloc", "type": "gauge", "condition": "<", "threshold": 10}
+	]`))
+	require.NoError(t, err)
+	engine, err := services.NewAlertEngine(service, rules, "")
+	require.NoError(t, err)
+	require.NoError(t, service.SaveGauge("HeapAlloc", 500))
+	require.NoError(t, engine.Evaluate())
+
+	e := handlers.New(service)
+	e.GET("/alerts", handlers.Alerts(engine))
+
+	get := func(target string) []model.Alert {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var alerts []model.Alert
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &alerts))
+		return alerts
+	}
+
+	alerts := get("/alerts")
+	assert.Equal(t, 2, len(alerts))
+	alerts = get("/alerts?state=firing")
+	assert.Equal(t, 1, len(alerts))
+	assert.Equal(t, "HighHeap", alerts[0].Rule)
+	assert.Equal(t, 500.0, *alerts[0].Value)
+	assert.Equal(t, 0, len(get("/alerts?state=pending")))
+}
+
+func TestSilences(t *testing.T) {
+	n := notifier.New(nil, nil, time.Hour)
+	e := handlers.New(services.NewMetricsService(repository.NewInMemoryStorage()))
+	e.GET("/silences", handlers.Silences(n))
+	e.POST("/silences", handlers.CreateSilence(n))
+	e.DELETE("/silences/:id", handlers.ExpireSilence(n))
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := serve(http.MethodPost, "/silences", `{"matcher":"Heap*","duration":"1h","comment":"deploy"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var created notifier.Silence
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	assert.Equal(t, "Heap*", created.Matcher)
+	assert.True(t, created.Active(time.Now()))
+
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/silences", `{"matcher":"Heap*","duration":"soon"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/silences", `{"matcher":"[","duration":"1h"}`).Code)
+
+	rec = serve(http.MethodDelete, "/silences/"+created.ID, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodDelete, "/silences/missing", "").Code)
+
+	rec = serve(http.MethodGet, "/silences", "")
+	var silences []notifier.Silence
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &silences))
+	require.Equal(t, 1, len(silences))
+	assert.False(t, silences[0].Active(time.Now()))
+}
+
+type recordingObserver struct {
+	events chan audit.Event
+}
+
+func (o *recordingObserver) Notify(ctx context.Context, e audit.Event) error {
+	o.events <- e
+	return nil
+}
+
+func TestAudit(t *testing.T) {
+	o := &recordingObserver{events: make(chan audit.Event, 10)}
+	a := audit.New(o)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := a.Run(ctx)
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	e := handlers.New(services.NewMetricsService(repository.NewInMemoryStorage()), middleware.Audit(a))
+	serve := func(target, body string) int {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderXRealIP, "192.168.1.10")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("/update/gauge/g1/1.5?label.host=a", ""))
+	assert.Equal(t, http.StatusOK, serve("/updates/", `[{"id":"c1","type":"counter","delta":1},{"id":"g2","type":"gauge","value":2}]`))
+	assert.Equal(t, http.StatusBadRequest, serve("/update/gauge/g1/none", ""))
+	assert.Equal(t, http.StatusOK, serve("/value/", `{"id":"g2","type":"gauge"}`))
+
+	event := <-o.events
+	assert.Equal(t, []string{`g1{host="a"}`}, event.Metrics)
+	assert.Equal(t, "192.168.1.10", event.IPAddress)
+	assert.NotZero(t, event.TS)
+	event = <-o.events
+	assert.Equal(t, []string{"c1", "g2"}, event.Metrics)
+	select {
+	case event = <-o.events:
+		t.Errorf("unexpected event %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func streamingServer(t *testing.T) (services.MetricsService, *httptest.Server) {
+	hub := services.NewHub()
+	service := services.MakeServiceStreaming(services.NewMetricsService(repository.NewInMemoryStorage()), hub)
+	e := handlers.New(service, middleware.HashSHA256("secret"))
+	e.GET("/stream", handlers.Stream(context.Background(), hub, 50*time.Millisecond))
+	e.GET("/ws", handlers.WebSocket(context.Background(), hub, 50*time.Millisecond))
+	ts := httptest.NewServer(e)
+	t.Cleanup(ts.Close)
+	return service, ts
+}
+
+func TestStreamWithoutAccept(t *testing.T) {
+	_, ts := streamingServer(t)
+
+	resp, err := http.Get(ts.URL + "/stream")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(hash.HeaderHashSHA256))
+
+	scanner := bufio.NewScanner(resp.Body)
+	require.True(t, scanner.Scan())
+	assert.Equal(t, "event: heartbeat", scanner.Text())
+}
+
+// waitSubscribed saves a marker gauge until the stream delivers it, so that later updates are not missed.
+func waitSubscribed(t *testing.T, service services.MetricsService, received func() model.Metrics) {
+	for i := 0; ; i++ {
+		require.Less(t, i, 100)
+		require.NoError(t, service.SaveGauge("Ready", 1))
+		if m := received(); m.ID == "Ready" {
+			return
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	service, ts := streamingServer(t)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/stream?type=counter&type=gauge&name=[PR]*", nil)
+	require.NoError(t, err)
+	req.Header.Set(echo.HeaderAccept, "text/event-stream")
+	req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get(echo.HeaderContentType))
+
+	var body io.Reader = resp.Body
+	if resp.Header.Get(echo.HeaderContentEncoding) == "gzip" {
+		body, err = gzip.NewReader(resp.Body)
+		require.NoError(t, err)
+	}
+	scanner := bufio.NewScanner(body)
+	next := func() (string, string) {
+		var event, data string
+		for scanner.Scan() && scanner.Text() != "" {
+			if v, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+				event = v
+			}
+			if v, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				data = v
+			}
+		}
+		return event, data
+	}
+	nextMetric := func() model.Metrics {
+		for {
+			event, data := next()
+			require.NotEmpty(t, event)
+			if event == "metric" {
+				var m model.Metrics
+				require.NoError(t, json.Unmarshal([]byte(data), &m))
+				return m
+			}
+		}
+	}
+	waitSubscribed(t, service, nextMetric)
+
+	_, err = service.Save(&model.Metrics{ID: "HeapAlloc", MType: "gauge", Value: new(float64)})
+	require.NoError(t, err)
+	delta := int64(5)
+	_, err = service.Save(&model.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+	require.NoError(t, err)
+
+	m := nextMetric()
+	assert.Equal(t, "PollCount", m.ID)
+	assert.Equal(t, int64(5), *m.Delta)
+
+	for {
+		event, data := next()
+		require.NotEmpty(t, event)
+		if event == "heartbeat" {
+			assert.Equal(t, `{"dropped":0}`, data)
+			break
+		}
+	}
+
+	resp, err = http.Get(ts.URL + "/stream?type=summary")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	_, ts := streamingServer(t)
+
+	handshake := func(origin string) int {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+		require.NoError(t, err)
+		defer conn.Close()
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/ws", nil)
+		require.NoError(t, err)
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		require.NoError(t, req.Write(conn))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, handshake(""))
+	assert.Equal(t, http.StatusSwitchingProtocols, handshake(ts.URL))
+	assert.Equal(t, http.StatusForbidden, handshake("http://evil.example"))
+}
+
+func TestWebSocket(t *testing.T) {
+	service, ts := streamingServer(t)
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?type=gauge"
+	ws, err := websocket.Dial(wsURL, "", ts.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	type message struct {
+		Event   string         `json:"event"`
+		Metric  *model.Metrics `json:"metric"`
+		Dropped *int64         `json:"dropped"`
+		Error   string         `json:"error"`
+	}
+	next := func(event string) message {
+		for {
+			var msg message
+			require.NoError(t, websocket.JSON.Receive(ws, &msg))
+			if msg.Event == event {
+				return msg
+			}
+		}
+	}
+	waitSubscribed(t, service, func() model.Metrics { return *next("metric").Metric })
+
+	require.NoError(t, websocket.JSON.Send(ws, services.StreamFilter{Types: []string{"summary"}}))
+	assert.NotEmpty(t, next("error").Error)
+
+	require.NoError(t, websocket.JSON.Send(ws, services.StreamFilter{Types: []string{"counter"}}))
+	// The filter is applied asynchronously: keep saving until the counter arrives.
+	delta := int64(1)
+	for {
+		_, err = service.Save(&model.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+		require.NoError(t, err)
+		var msg message
+		require.NoError(t, websocket.JSON.Receive(ws, &msg))
+		if msg.Event == "metric" && msg.Metric.MType == "counter" {
+			break
+		}
+	}
+	assert.Equal(t, int64(0), *next("heartbeat").Dropped)
+}
+
+func TestListMetrics(t *testing.T) {
+	storage := repository.NewInMemoryStorage()
+	storage.SaveGauge("HeapAlloc", 1)
+	storage.SaveGauge("HeapIdle", 2)
+	storage.SaveGauge("Alloc", 3)
+	storage.SaveCounter("PollCount", 4)
+	e := handlers.New(services.NewMetricsService(storage))
+
+	get := func(target string) (int, services.MetricsPage) {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var page services.MetricsPage
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		}
+		return rec.Code, page
+	}
+	ids := func(page services.MetricsPage) []string {
+		var result []string
+		for _, m := range page.Metrics {
+			result = append(result, m.ID)
+		}
+		return result
+	}
+
+	code, page := get("/api/v1/metrics?type=gauge&sort=-name&limit=2")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"HeapIdle", "HeapAlloc"}, ids(page))
+	require.NotEmpty(t, page.NextCursor)
+
+	code, page = get("/api/v1/metrics?type=gauge&sort=-name&limit=2&cursor=" + page.NextCursor)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"Alloc"}, ids(page))
+	assert.Empty(t, page.NextCursor)
+
+	_, page = get("/api/v1/metrics?type=counter,gauge&regex=Count$")
+	assert.Equal(t, []string{"PollCount"}, ids(page))
+	assert.Equal(t, int64(4), *page.Metrics[0].Delta)
+	_, page = get("/api/v1/metrics?prefix=Heap&glob=*Idle")
+	assert.Equal(t, []string{"HeapIdle"}, ids(page))
+
+	for _, target := range []string{
+		"/api/v1/metrics?sort=value",
+		"/api/v1/metrics?limit=0",
+		"/api/v1/metrics?limit=many",
+		"/api/v1/metrics?regex=(",
+		"/api/v1/metrics?type=summary",
+		"/api/v1/metrics?cursor=garbage",
+	} {
+		code, _ := get(target)
+		assert.Equal(t, http.StatusBadRequest, code, target)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	e := handlers.New(services.NewMetricsService(repository.NewInMemoryStorage()))
+
+	for _, path := range []string{"/ping", "/ping", "/value/gauge/none"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics/server", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `http_requests_total{method="GET",path="/ping",code="200"} 2`)
+	assert.Contains(t, rec.Body.String(), `http_requests_total{method="GET",path="/value/gauge/:measureName",code="404"} 1`)
+	assert.Contains(t, rec.Body.String(), `http_request_duration_seconds_count{method="GET",path="/ping",code="200"} 2`)
+}
+
+func TestInvalidConfiguration(t *testing.T) {
+	valid := config.ServerConfiguration{
+		AlertInterval:   time.Second,
+		AlertGroupWait:  time.Second,
+		StreamHeartbeat: time.Second,
+	}
+	require.NoError(t, valid.Validate())
+
+	tests := []struct {
+		name   string
+		modify func(c *config.ServerConfiguration)
+	}{
+		{"zero alert interval", func(c *config.ServerConfiguration) { c.AlertInterval = 0 }},
+		{"negative alert interval", func(c *config.ServerConfiguration) { c.AlertInterval = -time.Second }},
+		{"zero alert group wait", func(c *config.ServerConfiguration) { c.AlertGroupWait = 0 }},
+		{"zero stream heartbeat", func(c *config.ServerConfiguration) { c.StreamHeartbeat = 0 }},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			cfg := valid
+			test.modify(&cfg)
+			assert.Error(t, run(&cfg))
+		})
+	}
+}
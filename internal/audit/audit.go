@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/javaman/go-metrics/internal/model"
+)
+
+// ContextKey is the echo context key under which update handlers store the keys of saved metrics.
+const ContextKey = "audit.metrics"
+
+const (
+	queueSize   = 1024
+	postTimeout = 5 * time.Second
+)
+
+type Event struct {
+	TS        int64    `json:"ts"`
+	Metrics   []string `json:"metrics"`
+	IPAddress string   `json:"ip_address"`
+}
+
+func NewEvent(metrics []string, ip string) Event {
+	return Event{TS: time.Now().Unix(), Metrics: metrics, IPAddress: ip}
+}
+
+func Names(ms []model.Metrics) []string {
+	names := make([]string, 0, len(ms))
+	for i := range ms {
+		names = append(names, ms[i].Key())
+	}
+	return names
+}
+
+type Observer interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+// FileObserver appends events to a file, one JSON object per line.
+type FileObserver struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func NewFileObserver(path string) (*FileObserver, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileObserver{f: f}, nil
+}
+
+func (o *FileObserver) Notify(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, err = o.f.Write(append(data, '\n'))
+	return err
+}
+
+func (o *FileObserver) Close() error {
+	return o.f.Close()
+}
+
+type URLObserver struct {
+	client *resty.Client
+	url    string
+}
+
+func NewURLObserver(url string) *URLObserver {
+	return &URLObserver{client: resty.New().SetTimeout(postTimeout), url: url}
+}
+
+func (o *URLObserver) Notify(ctx context.Context, e Event) error {
+	resp, err := o.client.R().SetContext(ctx).SetBody(e).Post(o.url)
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("%s: %s", o.url, resp.Status())
+	}
+	return nil
+}
+
+// Auditor hands events to each observer through its own queue, so a slow observer neither blocks
+// the request path nor the others. Events are dropped when a queue is full.
+type Auditor struct {
+	observers []Observer
+	queues    []chan Event
+}
+
+func New(observers ...Observer) *Auditor {
+	a := &Auditor{observers: observers}
+	for range observers {
+		a.queues = append(a.queues, make(chan Event, queueSize))
+	}
+	return a
+}
+
+func (a *Auditor) Publish(e Event) {
+	if a == nil {
+		return
+	}
+	for i, q := range a.queues {
+		select {
+		case q <- e:
+		default:
+			log.Printf("audit: queue of observer %d is full, event dropped", i)
+		}
+	}
+}
+
+// Run delivers events until ctx is done, then delivers what is still queued and closes the returned channel.
+func (a *Auditor) Run(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range a.observers {
+		wg.Add(1)
+		go func(o Observer, q chan Event) {
+			defer wg.Done()
+			for {
+				select {
+				case e := <-q:
+					deliver(context.Background(), o, e)
+				case <-ctx.Done():
+					for {
+						select {
+						case e := <-q:
+							deliver(context.Background(), o, e)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}(a.observers[i], a.queues[i])
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func deliver(ctx context.Context, o Observer, e Event) {
+	if err := o.Notify(ctx, e); err != nil {
+		log.Println("audit:", err)
+	}
+}
@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	fileObserver, err := NewFileObserver(path)
+	require.NoError(t, err)
+	defer fileObserver.Close()
+
+	var mu sync.Mutex
+	var posted []Event
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		mu.Lock()
+		posted = append(posted, e)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a := New(fileObserver, NewURLObserver(ts.URL))
+	done := a.Run(ctx)
+
+	v := 1.5
+	first := NewEvent(Names([]model.Metrics{{ID: "g1", MType: "gauge", Value: &v, Labels: map[string]string{"host": "a"}}}), "10.0.0.1")
+	second := NewEvent([]string{"c1", "c2"}, "10.0.0.2")
+	a.Publish(first)
+	a.Publish(second)
+	cancel()
+	<-done
+
+	assert.Equal(t, []string{`g1{host="a"}`}, first.Metrics)
+	assert.Equal(t, []Event{first, second}, posted)
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var written []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		written = append(written, e)
+	}
+	assert.Equal(t, []Event{first, second}, written)
+}
+
+type blockingObserver struct {
+	release chan struct{}
+}
+
+func (o *blockingObserver) Notify(ctx context.Context, e Event) error {
+	<-o.release
+	return nil
+}
+
+func TestAuditorDoesNotBlock(t *testing.T) {
+	o := &blockingObserver{release: make(chan struct{})}
+	a := New(o)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := a.Run(ctx)
+
+	for i := 0; i < queueSize*2; i++ {
+		a.Publish(NewEvent([]string{"g1"}, ""))
+	}
+	close(o.release)
+	cancel()
+	<-done
+
+	var nilAuditor *Auditor
+	nilAuditor.Publish(NewEvent([]string{"g1"}, ""))
+}
@@ -2,21 +2,123 @@ package config
 
 import (
 	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v8"
+	"github.com/javaman/go-metrics/internal/retry"
 )
 
 type ServerConfiguration struct {
-	Address         string `env:"ADDRESS"`
-	StoreInterval   int    `env:"STORE_INTERVAL"`
-	FileStoragePath string `env:"FILE_STORAGE_PATH"`
-	Restore         bool   `env:"RESTORE"`
+	Address          string          `env:"ADDRESS"`
+	StoreInterval    int             `env:"STORE_INTERVAL"`
+	FileStoragePath  string          `env:"FILE_STORAGE_PATH"`
+	Restore          bool            `env:"RESTORE"`
+	DatabaseDSN      string          `env:"DATABASE_DSN"`
+	Key              string          `env:"KEY"`
+	RetryDelays      []time.Duration `env:"RETRY_DELAYS" envSeparator:","`
+	HistorySize      int             `env:"HISTORY_SIZE"`
+	HistoryRetention time.Duration   `env:"HISTORY_RETENTION"`
+	MetricTTL        time.Duration   `env:"METRIC_TTL"`
+	EvictStale       bool            `env:"EVICT_STALE"`
+	GRPCAddress      string          `env:"GRPC_ADDRESS"`
+	CryptoKey        string          `env:"CRYPTO_KEY"`
+	TrustedSubnet    string          `env:"TRUSTED_SUBNET"`
+	AlertRules       string          `env:"ALERT_RULES"`
+	AlertInterval    time.Duration   `env:"ALERT_INTERVAL"`
+	AlertStateFile   string          `env:"ALERT_STATE_FILE"`
+	AlertWebhooks    []string        `env:"ALERT_WEBHOOKS" envSeparator:","`
+	AlertGroupWait   time.Duration   `env:"ALERT_GROUP_WAIT"`
+	AlertRepeat      time.Duration   `env:"ALERT_REPEAT_INTERVAL"`
+	AuditFile        string          `env:"AUDIT_FILE"`
+	AuditURL         string          `env:"AUDIT_URL"`
+	StreamHeartbeat  time.Duration   `env:"STREAM_HEARTBEAT"`
 }
 
 type AgentConfiguration struct {
-	Address        string `env:"ADDRESS"`
-	ReportInterval int    `env:"REPORT_INTERVAL"`
-	PollInterval   int    `env:"POLL_INTERVAL"`
+	Address           string            `env:"ADDRESS"`
+	ReportInterval    int               `env:"REPORT_INTERVAL"`
+	PollInterval      int               `env:"POLL_INTERVAL"`
+	Key               string            `env:"KEY"`
+	RetryDelays       []time.Duration   `env:"RETRY_DELAYS" envSeparator:","`
+	RateLimit         int               `env:"RATE_LIMIT"`
+	Collectors        []string          `env:"COLLECTORS" envSeparator:","`
+	CollectorPrefixes map[string]string `env:"COLLECTOR_PREFIXES" envSeparator:","`
+	CollectorScript   string            `env:"COLLECTOR_SCRIPT"`
+	Labels            map[string]string `env:"LABELS" envSeparator:","`
+	InstanceID        string            `env:"INSTANCE_ID"`
+	HostLabel         bool              `env:"HOST_LABEL"`
+	HistogramBuckets  []float64         `env:"HISTOGRAM_BUCKETS" envSeparator:","`
+	GRPCAddress       string            `env:"GRPC_ADDRESS"`
+	CryptoKey         string            `env:"CRYPTO_KEY"`
+}
+
+func durationsFlag(name string, target *[]time.Duration, defaultValue []time.Duration, usage string) {
+	*target = defaultValue
+	flag.Func(name, usage, func(s string) error {
+		var result []time.Duration
+		for _, part := range splitList(s) {
+			d, err := time.ParseDuration(part)
+			if err != nil {
+				return err
+			}
+			result = append(result, d)
+		}
+		*target = result
+		return nil
+	})
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			result = append(result, part)
+		}
+	}
+	return result
+}
+
+func stringsFlag(name string, target *[]string, defaultValue []string, usage string) {
+	*target = defaultValue
+	flag.Func(name, usage, func(s string) error {
+		*target = splitList(s)
+		return nil
+	})
+}
+
+func floatsFlag(name string, target *[]float64, defaultValue []float64, usage string) {
+	*target = defaultValue
+	flag.Func(name, usage, func(s string) error {
+		var result []float64
+		for _, part := range splitList(s) {
+			v, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return err
+			}
+			result = append(result, v)
+		}
+		*target = result
+		return nil
+	})
+}
+
+func mapFlag(name string, target *map[string]string, usage string) {
+	*target = make(map[string]string)
+	flag.Func(name, usage, func(s string) error {
+		result := make(map[string]string)
+		for _, part := range splitList(s) {
+			k, v, found := strings.Cut(part, ":")
+			if !found {
+				return fmt.Errorf("%q should be in \"key:value\" format", part)
+			}
+			result[k] = v
+		}
+		*target = result
+		return nil
+	})
 }
 
 func ConfigureServer() *ServerConfiguration {
@@ -26,6 +128,25 @@ func ConfigureServer() *ServerConfiguration {
 	flag.IntVar(&conf.StoreInterval, "i", 300, "Интервал сохранения на диск. 0 - синхронно")
 	flag.StringVar(&conf.FileStoragePath, "f", "/tmp/metrics-db.json", "Файл, где сохраняются метрики")
 	flag.BoolVar(&conf.Restore, "r", false, "Загрузить ли ранее сохраненные значения")
+	flag.StringVar(&conf.DatabaseDSN, "d", "", "Строка подключения к PostgreSQL")
+	flag.StringVar(&conf.Key, "k", "", "Ключ для подписи запросов")
+	durationsFlag("retry-delays", &conf.RetryDelays, retry.DefaultDelays, "Паузы между повторными попытками записи, через запятую")
+	flag.IntVar(&conf.HistorySize, "history-size", 0, "Количество хранимых значений каждой метрики для истории. 0 - история отключена")
+	flag.DurationVar(&conf.HistoryRetention, "history-retention", 24*time.Hour, "Время хранения истории метрик")
+	flag.DurationVar(&conf.MetricTTL, "metric-ttl", 0, "Время без обновлений, после которого gauge считается устаревшим. 0 - не устаревает")
+	flag.BoolVar(&conf.EvictStale, "evict-stale", false, "Удалять устаревшие gauge вместо пометки")
+	flag.StringVar(&conf.GRPCAddress, "grpc-address", "", "Адрес gRPC сервера. Пусто - gRPC отключен")
+	flag.StringVar(&conf.CryptoKey, "crypto-key", "", "Путь к файлу с приватным RSA ключом для расшифровки запросов и TLS на gRPC")
+	flag.StringVar(&conf.TrustedSubnet, "t", "", "Доверенная подсеть агентов в формате CIDR. Пусто - без ограничений")
+	flag.StringVar(&conf.AlertRules, "alert-rules", "", "Файл с правилами оповещений в формате JSON. Пусто - оповещения отключены")
+	flag.DurationVar(&conf.AlertInterval, "alert-interval", 15*time.Second, "Интервал проверки правил оповещений")
+	flag.StringVar(&conf.AlertStateFile, "alert-state-file", "/tmp/metrics-alerts.json", "Файл, где сохраняется состояние оповещений")
+	stringsFlag("alert-webhooks", &conf.AlertWebhooks, nil, "Адреса webhook для отправки оповещений, через запятую")
+	flag.DurationVar(&conf.AlertGroupWait, "alert-group-wait", 30*time.Second, "Интервал, за который изменения оповещений объединяются в одно уведомление")
+	flag.DurationVar(&conf.AlertRepeat, "alert-repeat-interval", 4*time.Hour, "Интервал повторной отправки уведомлений о непогашенных оповещениях")
+	flag.StringVar(&conf.AuditFile, "audit-file", "", "Файл журнала аудита обновлений метрик. Пусто - не записывать")
+	flag.StringVar(&conf.AuditURL, "audit-url", "", "Адрес, куда отправляются события аудита. Пусто - не отправлять")
+	flag.DurationVar(&conf.StreamHeartbeat, "stream-heartbeat", 15*time.Second, "Интервал heartbeat сообщений в потоках /stream и /ws")
 	flag.Parse()
 
 	env.Parse(conf)
@@ -33,12 +154,38 @@ func ConfigureServer() *ServerConfiguration {
 	return conf
 }
 
+// Validate rejects settings the server can't run with.
+func (c *ServerConfiguration) Validate() error {
+	if c.AlertInterval <= 0 {
+		return fmt.Errorf("alert-interval must be positive, got %s", c.AlertInterval)
+	}
+	if c.AlertGroupWait <= 0 {
+		return fmt.Errorf("alert-group-wait must be positive, got %s", c.AlertGroupWait)
+	}
+	if c.StreamHeartbeat <= 0 {
+		return fmt.Errorf("stream-heartbeat must be positive, got %s", c.StreamHeartbeat)
+	}
+	return nil
+}
+
 func ConfigureAgent() *AgentConfiguration {
 	conf := &AgentConfiguration{}
 
 	flag.StringVar(&conf.Address, "a", "localhost:8080", "Адрес сервера")
 	flag.IntVar(&conf.ReportInterval, "r", 10, "Частота отправки на сервер")
 	flag.IntVar(&conf.PollInterval, "p", 2, "Частота опроса метрик")
+	flag.IntVar(&conf.RateLimit, "l", 1, "Количество одновременно исходящих запросов")
+	flag.StringVar(&conf.Key, "k", "", "Ключ для подписи запросов")
+	durationsFlag("retry-delays", &conf.RetryDelays, retry.DefaultDelays, "Паузы между повторными попытками отправки, через запятую")
+	stringsFlag("collectors", &conf.Collectors, []string{"memstats", "host"}, "Включенные сборщики метрик: memstats, runtime, process, host, gcpause, script")
+	mapFlag("collector-prefixes", &conf.CollectorPrefixes, "Префиксы имен метрик по сборщикам, например host:host_,process:proc_")
+	flag.StringVar(&conf.CollectorScript, "collector-script", "", "Команда, вывод которой собирается сборщиком script")
+	mapFlag("labels", &conf.Labels, "Дополнительные метки для всех метрик, например service:api,env:prod")
+	flag.StringVar(&conf.InstanceID, "instance", "", "Идентификатор экземпляра агента, добавляется меткой instance")
+	flag.BoolVar(&conf.HostLabel, "host-label", false, "Добавлять к метрикам метку host с именем хоста")
+	flag.StringVar(&conf.GRPCAddress, "grpc-address", "", "Адрес gRPC сервера. Если задан, метрики отправляются по gRPC")
+	flag.StringVar(&conf.CryptoKey, "crypto-key", "", "Путь к файлу с публичным RSA ключом сервера для шифрования запросов и проверки gRPC сервера")
+	floatsFlag("histogram-buckets", &conf.HistogramBuckets, []float64{0.00001, 0.0001, 0.001, 0.01, 0.1, 1}, "Границы корзин гистограмм в секундах, через запятую")
 	flag.Parse()
 
 	env.Parse(conf)
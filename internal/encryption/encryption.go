@@ -0,0 +1,138 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	HeaderEncryption = "X-Encryption"
+	Scheme           = "rsa-oaep-aes-gcm"
+)
+
+var ErrMalformed = errors.New("malformed encrypted payload")
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	return block, nil
+}
+
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+		return nil, fmt.Errorf("%s: not an RSA public key", path)
+	default:
+		return nil, fmt.Errorf("%s: unexpected PEM block %q", path, block.Type)
+	}
+}
+
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+			return rsaKey, nil
+		}
+		return nil, fmt.Errorf("%s: not an RSA private key", path)
+	default:
+		return nil, fmt.Errorf("%s: unexpected PEM block %q", path, block.Type)
+	}
+}
+
+// Encrypt seals data with a fresh AES-256-GCM key and wraps that key with RSA-OAEP,
+// so the payload size is not limited by the RSA key size. The result is
+// key length (2 bytes), wrapped key, nonce, ciphertext.
+func Encrypt(key *rsa.PublicKey, data []byte) ([]byte, error) {
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, err
+	}
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, sessionKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, 2, 2+len(wrappedKey)+len(nonce)+len(data)+gcm.Overhead())
+	binary.BigEndian.PutUint16(result, uint16(len(wrappedKey)))
+	result = append(result, wrappedKey...)
+	result = append(result, nonce...)
+	return gcm.Seal(result, nonce, data, nil), nil
+}
+
+func Decrypt(key *rsa.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, ErrMalformed
+	}
+	keyLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < keyLen {
+		return nil, ErrMalformed
+	}
+	sessionKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, data[:keyLen], nil)
+	if err != nil {
+		return nil, err
+	}
+	data = data[keyLen:]
+	gcm, err := newGCM(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
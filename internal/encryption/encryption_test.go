@@ -0,0 +1,79 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte(`{"id":"g1","type":"gauge","value":3.14}`), 1000)
+	encrypted, err := Encrypt(&key.PublicKey, data)
+	require.NoError(t, err)
+	assert.NotContains(t, string(encrypted), `"gauge"`)
+
+	decrypted, err := Decrypt(key, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	encrypted[len(encrypted)-1] ^= 1
+	_, err = Decrypt(key, encrypted)
+	assert.Error(t, err)
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	encrypted, err = Encrypt(&other.PublicKey, data)
+	require.NoError(t, err)
+	_, err = Decrypt(key, encrypted)
+	assert.Error(t, err)
+
+	_, err = Decrypt(key, []byte{1})
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	pkix, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	files := map[string]*pem.Block{
+		"pkcs1.pem":    {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+		"pkcs8.pem":    {Type: "PRIVATE KEY", Bytes: pkcs8},
+		"pkcs1pub.pem": {Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)},
+		"pkix.pem":     {Type: "PUBLIC KEY", Bytes: pkix},
+	}
+	for name, block := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600))
+	}
+
+	for _, name := range []string{"pkcs1.pem", "pkcs8.pem"} {
+		loaded, err := LoadPrivateKey(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.True(t, key.Equal(loaded))
+	}
+	for _, name := range []string{"pkcs1pub.pem", "pkix.pem"} {
+		loaded, err := LoadPublicKey(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.True(t, key.PublicKey.Equal(loaded))
+	}
+
+	_, err = LoadPublicKey(filepath.Join(dir, "pkcs1.pem"))
+	assert.Error(t, err)
+	_, err = LoadPrivateKey(filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+}
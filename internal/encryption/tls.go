@@ -0,0 +1,55 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"time"
+)
+
+var ErrKeyMismatch = errors.New("server key does not match the configured public key")
+
+// SelfSignedCertificate wraps the server key into a certificate for TLS. Clients don't check it
+// against a CA but pin the public key instead, see PinnedTLSConfig.
+func SelfSignedCertificate(key *rsa.PrivateKey) (tls.Certificate, error) {
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: "go-metrics"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// PinnedTLSConfig accepts only a server whose certificate carries the given public key.
+func PinnedTLSConfig(key *rsa.PublicKey) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// the chain is not verified against a CA, VerifyPeerCertificate checks the key instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrKeyMismatch
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if !key.Equal(cert.PublicKey) {
+				return ErrKeyMismatch
+			}
+			return nil
+		},
+	}
+}
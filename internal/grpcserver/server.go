@@ -0,0 +1,240 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/javaman/go-metrics/internal/audit"
+	pb "github.com/javaman/go-metrics/internal/proto"
+	"github.com/javaman/go-metrics/internal/services"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+type MetricsServer struct {
+	pb.UnimplementedMetricsServer
+	service services.MetricsService
+	auditor *audit.Auditor
+}
+
+func NewMetricsServer(service services.MetricsService, auditor *audit.Auditor) *MetricsServer {
+	return &MetricsServer{service: service, auditor: auditor}
+}
+
+func (s *MetricsServer) audit(ctx context.Context, names []string) {
+	var ip string
+	if p, ok := peer.FromContext(ctx); ok {
+		ip = p.Addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+	s.auditor.Publish(audit.NewEvent(names, ip))
+}
+
+// New creates the gRPC server. Interceptors passed in opts with grpc.ChainUnaryInterceptor
+// run before signature verification.
+func New(service services.MetricsService, key string, auditor *audit.Auditor, opts ...grpc.ServerOption) *grpc.Server {
+	if key != "" {
+		opts = append(opts, grpc.ChainUnaryInterceptor(HashSHA256(key)), grpc.ChainStreamInterceptor(StreamHashSHA256(key)))
+	}
+	s := grpc.NewServer(opts...)
+	pb.RegisterMetricsServer(s, NewMetricsServer(service, auditor))
+	return s
+}
+
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, services.ErrIDNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, services.ErrIDRequired),
+		errors.Is(err, services.ErrInvalidMType),
+		errors.Is(err, services.ErrDeltaRequired),
+		errors.Is(err, services.ErrValueRequired),
+		errors.Is(err, services.ErrInvalidLabels),
+		errors.Is(err, services.ErrHistogramRequired),
+		errors.Is(err, services.ErrInvalidHistogram):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, services.ErrNotApplied):
+		return status.Error(codes.Aborted, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func (s *MetricsServer) Update(ctx context.Context, m *pb.Metric) (*pb.Metric, error) {
+	res, err := s.service.Save(pb.ToModel(m))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	s.audit(ctx, []string{res.Key()})
+	return pb.FromModel(res), nil
+}
+
+func (s *MetricsServer) UpdateBatch(ctx context.Context, b *pb.MetricsBatch) (*pb.MetricsBatch, error) {
+	res, err := s.service.SaveBatch(pb.ToModelBatch(b))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	s.audit(ctx, audit.Names(res))
+	return pb.FromModelBatch(res), nil
+}
+
+func (s *MetricsServer) Value(ctx context.Context, m *pb.Metric) (*pb.Metric, error) {
+	res, err := s.service.Value(pb.ToModel(m))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return pb.FromModel(res), nil
+}
+
+func (s *MetricsServer) List(ctx context.Context, r *pb.ListRequest) (*pb.MetricsBatch, error) {
+	res, err := s.service.AllMetrics(r.GetLabels())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return pb.FromModelBatch(res), nil
+}
+
+func (s *MetricsServer) Push(stream pb.Metrics_PushServer) error {
+	var accepted uint64
+	var names []string
+	defer func() {
+		if len(names) > 0 {
+			s.audit(stream.Context(), names)
+		}
+	}()
+	for {
+		m, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&pb.PushResponse{Accepted: accepted})
+		}
+		if err != nil {
+			return err
+		}
+		res, err := s.service.Save(pb.ToModel(m))
+		if err != nil {
+			return toStatus(err)
+		}
+		names = append(names, res.Key())
+		accepted++
+	}
+}
+
+func HashSHA256(key string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		signatures := md.Get(pb.MetadataHashSHA256)
+		if len(signatures) == 0 {
+			return nil, status.Error(codes.Unauthenticated, "request signature is missing")
+		}
+		valid, err := pb.Verify(key, req.(proto.Message), signatures[0])
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if !valid {
+			return nil, status.Error(codes.Unauthenticated, "request signature mismatch")
+		}
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := pb.Sign(key, resp.(proto.Message))
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		grpc.SetHeader(ctx, metadata.Pairs(pb.MetadataHashSHA256, signature))
+		return resp, nil
+	}
+}
+
+func isUpdateMethod(method string) bool {
+	return method == pb.Metrics_Update_FullMethodName ||
+		method == pb.Metrics_UpdateBatch_FullMethodName ||
+		method == pb.Metrics_Push_FullMethodName
+}
+
+func checkRealIP(ctx context.Context, subnet *net.IPNet) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(pb.MetadataRealIP)
+	if len(values) == 0 {
+		return status.Error(codes.PermissionDenied, "untrusted address")
+	}
+	ip := net.ParseIP(values[0])
+	if ip == nil || !subnet.Contains(ip) {
+		return status.Error(codes.PermissionDenied, "untrusted address")
+	}
+	return nil
+}
+
+// TrustedSubnet accepts updates only from agents whose x-real-ip metadata belongs to subnet.
+func TrustedSubnet(subnet *net.IPNet) []grpc.ServerOption {
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if isUpdateMethod(info.FullMethod) {
+			if err := checkRealIP(ctx, subnet); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if isUpdateMethod(info.FullMethod) {
+			if err := checkRealIP(ss.Context(), subnet); err != nil {
+				return err
+			}
+		}
+		return handler(srv, ss)
+	}
+	return []grpc.ServerOption{grpc.ChainUnaryInterceptor(unary), grpc.ChainStreamInterceptor(stream)}
+}
+
+type signedStream struct {
+	grpc.ServerStream
+	key string
+}
+
+func (s *signedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	metric, ok := m.(*pb.Metric)
+	if !ok {
+		return status.Error(codes.Internal, "unexpected stream message")
+	}
+	if metric.GetHash() == "" {
+		return status.Error(codes.Unauthenticated, "message signature is missing")
+	}
+	valid, err := pb.VerifyMetric(s.key, metric)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !valid {
+		return status.Error(codes.Unauthenticated, "message signature mismatch")
+	}
+	return nil
+}
+
+func (s *signedStream) SendMsg(m any) error {
+	signature, err := pb.Sign(s.key, m.(proto.Message))
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := s.SetHeader(metadata.Pairs(pb.MetadataHashSHA256, signature)); err != nil {
+		return err
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// StreamHashSHA256 verifies the hash of every streamed metric, see pb.SignMetric,
+// and signs the response in the header like HashSHA256.
+func StreamHashSHA256(key string) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &signedStream{ss, key})
+	}
+}
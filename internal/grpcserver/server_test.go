@@ -0,0 +1,198 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+
+	"github.com/javaman/go-metrics/internal/encryption"
+	pb "github.com/javaman/go-metrics/internal/proto"
+	"github.com/javaman/go-metrics/internal/repository"
+	"github.com/javaman/go-metrics/internal/services"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func serveTest(t *testing.T, s *grpc.Server, opts ...grpc.DialOption) pb.MetricsClient {
+	listener := bufconn.Listen(1024 * 1024)
+	go s.Serve(listener)
+	t.Cleanup(s.Stop)
+
+	opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }))
+	conn, err := grpc.Dial("bufnet", opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewMetricsClient(conn)
+}
+
+func newTestClient(t *testing.T, key string) pb.MetricsClient {
+	s := New(services.NewMetricsService(repository.NewInMemoryStorage()), key, nil)
+	return serveTest(t, s, grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestMetricsServer(t *testing.T) {
+	client := newTestClient(t, "")
+	ctx := context.Background()
+
+	res, err := client.Update(ctx, &pb.Metric{Id: "PollCount", Type: "counter", Delta: ptr(int64(2))})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), res.GetDelta())
+
+	batch, err := client.UpdateBatch(ctx, &pb.MetricsBatch{Metrics: []*pb.Metric{
+		{Id: "PollCount", Type: "counter", Delta: ptr(int64(3))},
+		{Id: "Alloc", Type: "gauge", Value: ptr(1.5), Labels: map[string]string{"host": "h1"}},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), batch.GetMetrics()[0].GetDelta())
+
+	res, err = client.Value(ctx, &pb.Metric{Id: "Alloc", Type: "gauge", Labels: map[string]string{"host": "h1"}})
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, res.GetValue())
+
+	res, err = client.Value(ctx, &pb.Metric{Id: "Alloc", Type: "gauge"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"host": "h1"}, res.GetLabels())
+	_, err = client.Value(ctx, &pb.Metric{Id: "Missing", Type: "gauge"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Update(ctx, &pb.Metric{Id: "Alloc", Type: "gauge"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	list, err := client.List(ctx, &pb.ListRequest{Labels: map[string]string{"host": "h1"}})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(list.GetMetrics()))
+	assert.Equal(t, "Alloc", list.GetMetrics()[0].GetId())
+
+	stream, err := client.Push(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, stream.Send(&pb.Metric{Id: "PollCount", Type: "counter", Delta: ptr(int64(1))}))
+	}
+	pushed, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), pushed.GetAccepted())
+
+	res, err = client.Value(ctx, &pb.Metric{Id: "PollCount", Type: "counter"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), res.GetDelta())
+}
+
+func TestMetricsServerSigned(t *testing.T) {
+	client := newTestClient(t, "secret")
+	req := &pb.Metric{Id: "Alloc", Type: "gauge", Value: ptr(1.5)}
+
+	_, err := client.Update(context.Background(), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	wrong, err := pb.Sign("other", req)
+	require.NoError(t, err)
+	_, err = client.Update(metadata.AppendToOutgoingContext(context.Background(), pb.MetadataHashSHA256, wrong), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	signature, err := pb.Sign("secret", req)
+	require.NoError(t, err)
+	var header metadata.MD
+	res, err := client.Update(metadata.AppendToOutgoingContext(context.Background(), pb.MetadataHashSHA256, signature), req, grpc.Header(&header))
+	require.NoError(t, err)
+	valid, err := pb.Verify("secret", res, header.Get(pb.MetadataHashSHA256)[0])
+	require.NoError(t, err)
+	assert.True(t, valid)
+
+	push := func(sign func(m *pb.Metric)) (*pb.PushResponse, metadata.MD, error) {
+		stream, err := client.Push(context.Background())
+		require.NoError(t, err)
+		for _, m := range []*pb.Metric{
+			{Id: "PollCount", Type: "counter", Delta: ptr(int64(1))},
+			{Id: "Alloc", Type: "gauge", Value: ptr(1.5)},
+		} {
+			sign(m)
+			if err := stream.Send(m); err != nil {
+				break
+			}
+		}
+		res, err := stream.CloseAndRecv()
+		header, _ := stream.Header()
+		return res, header, err
+	}
+
+	_, _, err = push(func(*pb.Metric) {})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, _, err = push(func(m *pb.Metric) { require.NoError(t, pb.SignMetric("other", m)) })
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	pushed, header, err := push(func(m *pb.Metric) { require.NoError(t, pb.SignMetric("secret", m)) })
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), pushed.GetAccepted())
+	valid, err = pb.Verify("secret", pushed, header.Get(pb.MetadataHashSHA256)[0])
+	require.NoError(t, err)
+	assert.True(t, valid)
+}
+
+func TestMetricsServerTLS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	cert, err := encryption.SelfSignedCertificate(key)
+	require.NoError(t, err)
+	newServer := func() *grpc.Server {
+		return New(services.NewMetricsService(repository.NewInMemoryStorage()), "", nil, grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	}
+	ctx := context.Background()
+
+	client := serveTest(t, newServer(), grpc.WithTransportCredentials(credentials.NewTLS(encryption.PinnedTLSConfig(&key.PublicKey))))
+	res, err := client.Update(ctx, &pb.Metric{Id: "PollCount", Type: "counter", Delta: ptr(int64(2))})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), res.GetDelta())
+
+	client = serveTest(t, newServer(), grpc.WithTransportCredentials(credentials.NewTLS(encryption.PinnedTLSConfig(&other.PublicKey))))
+	_, err = client.Update(ctx, &pb.Metric{Id: "PollCount", Type: "counter", Delta: ptr(int64(2))})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	client = serveTest(t, newServer(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	_, err = client.Update(ctx, &pb.Metric{Id: "PollCount", Type: "counter", Delta: ptr(int64(2))})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestMetricsServerTrustedSubnet(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	s := New(services.NewMetricsService(repository.NewInMemoryStorage()), "", nil, TrustedSubnet(subnet)...)
+	client := serveTest(t, s, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	metric := &pb.Metric{Id: "PollCount", Type: "counter", Delta: ptr(int64(2))}
+	withIP := func(ip string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), pb.MetadataRealIP, ip)
+	}
+
+	_, err = client.Update(context.Background(), metric)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Update(withIP("192.168.1.1"), metric)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Update(withIP("10.1.2.3"), metric)
+	assert.NoError(t, err)
+
+	stream, err := client.Push(context.Background())
+	require.NoError(t, err)
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.Value(context.Background(), &pb.Metric{Id: "PollCount", Type: "counter"})
+	assert.NoError(t, err)
+}
+
+func TestToStatusNotApplied(t *testing.T) {
+	assert.Equal(t, codes.Aborted, status.Code(toStatus(services.ErrNotApplied)))
+	assert.Equal(t, codes.Internal, status.Code(toStatus(assert.AnError)))
+}
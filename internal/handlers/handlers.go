@@ -2,13 +2,18 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/javaman/go-metrics/internal/audit"
 	mymiddleware "github.com/javaman/go-metrics/internal/middleware"
 	"github.com/javaman/go-metrics/internal/model"
+	"github.com/javaman/go-metrics/internal/notifier"
 	"github.com/javaman/go-metrics/internal/services"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -23,14 +28,87 @@ func NotFound(c echo.Context) error {
 	return c.NoContent(http.StatusNotFound)
 }
 
+// InternalServerError answers 503 to updates that were not applied, agents send only those again.
+func InternalServerError(c echo.Context, err error) error {
+	if errors.Is(err, services.ErrNotApplied) {
+		return c.String(http.StatusServiceUnavailable, err.Error())
+	}
+	return c.String(http.StatusInternalServerError, err.Error())
+}
+
+func isValidationError(err error) bool {
+	return errors.Is(err, services.ErrInvalidMType) ||
+		errors.Is(err, services.ErrDeltaRequired) ||
+		errors.Is(err, services.ErrValueRequired) ||
+		errors.Is(err, services.ErrInvalidLabels) ||
+		errors.Is(err, services.ErrHistogramRequired) ||
+		errors.Is(err, services.ErrInvalidHistogram)
+}
+
+const labelParamPrefix = "label."
+
+// labelsFromQuery collects labels given as label.<name>=<value> query parameters; other parameters are ignored.
+func labelsFromQuery(c echo.Context) map[string]string {
+	var labels map[string]string
+	for k, v := range c.QueryParams() {
+		name, ok := strings.CutPrefix(k, labelParamPrefix)
+		if !ok {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[name] = v[0]
+	}
+	return labels
+}
+
+func parseTime(s string, defaultValue time.Time) (time.Time, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func parseStep(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		s = fmt.Sprintf("%ds", seconds)
+	}
+	step, err := time.ParseDuration(s)
+	if err == nil && step < 0 {
+		return 0, fmt.Errorf("negative step %s", s)
+	}
+	return step, err
+}
+
+func saveStatus(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, services.ErrIDRequired):
+		return NotFound(c)
+	case isValidationError(err):
+		return BadRequest(c)
+	default:
+		return InternalServerError(c, err)
+	}
+}
+
 func ValueGauge(s services.MetricsService) func(echo.Context) error {
 	return func(c echo.Context) error {
 		measureName := c.Param("measureName")
-		if value, found := s.GetGauge(measureName); found {
-			return c.String(http.StatusOK, strconv.FormatFloat(value, 'f', -1, 64))
-		} else {
+		m, err := s.Value(&model.Metrics{ID: measureName, MType: "gauge", Labels: labelsFromQuery(c)})
+		switch {
+		case errors.Is(err, services.ErrIDNotFound):
 			return NotFound(c)
+		case err != nil:
+			return InternalServerError(c, err)
 		}
+		return c.String(http.StatusOK, strconv.FormatFloat(*m.Value, 'f', -1, 64))
 	}
 }
 
@@ -41,7 +119,11 @@ func UpdateGauge(s services.MetricsService) func(echo.Context) error {
 			return NotFound(c)
 		}
 		if measureValue, err := strconv.ParseFloat(c.Param("measureValue"), 64); err == nil {
-			s.SaveGauge(measureName, measureValue)
+			m := &model.Metrics{ID: measureName, MType: "gauge", Value: &measureValue, Labels: labelsFromQuery(c)}
+			if _, err := s.Save(m); err != nil {
+				return saveStatus(c, err)
+			}
+			c.Set(audit.ContextKey, []string{m.Key()})
 			return c.NoContent(http.StatusOK)
 		} else {
 			return BadRequest(c)
@@ -54,13 +136,39 @@ func ValueCounter(s services.MetricsService) func(echo.Context) error {
 		measureName := c.Param("measureName")
 		fmt.Println(c.ParamNames())
 		fmt.Println(c.ParamValues())
-		if value, found := s.GetCounter(measureName); found {
-			return c.String(http.StatusOK, fmt.Sprintf("%d", value))
-		} else {
+		m, err := s.Value(&model.Metrics{ID: measureName, MType: "counter", Labels: labelsFromQuery(c)})
+		switch {
+		case errors.Is(err, services.ErrIDNotFound):
 			return NotFound(c)
+		case err != nil:
+			return InternalServerError(c, err)
 		}
+		return c.String(http.StatusOK, fmt.Sprintf("%d", *m.Delta))
 	}
 }
+func ValueHistogram(s services.MetricsService) func(echo.Context) error {
+	return func(c echo.Context) error {
+		measureName := c.Param("measureName")
+		m, err := s.Value(&model.Metrics{ID: measureName, MType: "histogram", Labels: labelsFromQuery(c)})
+		switch {
+		case errors.Is(err, services.ErrIDNotFound):
+			return NotFound(c)
+		case err != nil:
+			return InternalServerError(c, err)
+		}
+		h := m.Histogram
+		var b strings.Builder
+		cumulative := h.Cumulative()
+		for i, bound := range h.Bounds {
+			fmt.Fprintf(&b, "le=%s %d\n", strconv.FormatFloat(bound, 'f', -1, 64), cumulative[i])
+		}
+		fmt.Fprintf(&b, "le=+Inf %d\n", h.Count)
+		fmt.Fprintf(&b, "sum %s\n", strconv.FormatFloat(h.Sum, 'f', -1, 64))
+		fmt.Fprintf(&b, "count %d\n", h.Count)
+		return c.String(http.StatusOK, b.String())
+	}
+}
+
 func UpdateCounter(s services.MetricsService) func(echo.Context) error {
 	return func(c echo.Context) error {
 		metricName := c.Param("measureName")
@@ -68,7 +176,11 @@ func UpdateCounter(s services.MetricsService) func(echo.Context) error {
 			return NotFound(c)
 		}
 		if metricValue, err := strconv.ParseInt(c.Param("measureValue"), 10, 64); err == nil {
-			s.SaveCounter(metricName, metricValue)
+			m := &model.Metrics{ID: metricName, MType: "counter", Delta: &metricValue, Labels: labelsFromQuery(c)}
+			if _, err := s.Save(m); err != nil {
+				return saveStatus(c, err)
+			}
+			c.Set(audit.ContextKey, []string{m.Key()})
 			return c.NoContent(http.StatusOK)
 		} else {
 			return BadRequest(c)
@@ -78,14 +190,32 @@ func UpdateCounter(s services.MetricsService) func(echo.Context) error {
 
 func ListAll(s services.MetricsService) func(echo.Context) error {
 	return func(e echo.Context) error {
+		metrics, err := s.AllMetrics(labelsFromQuery(e))
+		if err != nil {
+			return InternalServerError(e, err)
+		}
 		var b strings.Builder
 		b.WriteString("<html><head><title>AllMetrics</title></head><body><table>")
-		s.AllGauges(func(n string, v float64) {
-			b.WriteString(fmt.Sprintf("<tr><td>%s</td><td>%f</td></tr>", n, v))
-		})
-		s.AllCounters(func(n string, v int64) {
-			b.WriteString(fmt.Sprintf("<tr><td>%s</td><td>%d</td></tr>", n, v))
-		})
+		for _, m := range metrics {
+			name := html.EscapeString(m.Key())
+			var value string
+			switch m.MType {
+			case "gauge":
+				value = fmt.Sprintf("%f", *m.Value)
+			case "counter":
+				value = fmt.Sprintf("%d", *m.Delta)
+			case "histogram":
+				value = fmt.Sprintf("count=%d sum=%f", m.Histogram.Count, m.Histogram.Sum)
+			}
+			var updated string
+			if m.Timestamp != nil {
+				updated = m.Timestamp.Format(time.RFC3339)
+			}
+			if m.Stale {
+				updated += " (stale)"
+			}
+			b.WriteString(fmt.Sprintf("<tr><td>%s</td><td>%s</td><td>%s</td></tr>", name, value, updated))
+		}
 		b.WriteString("</table></body></html>")
 		return e.HTML(http.StatusOK, b.String())
 	}
@@ -100,13 +230,32 @@ func Update(s services.MetricsService) func(echo.Context) error {
 		}
 		res, err := s.Save(&m)
 		if err != nil {
-			switch err {
-			case services.ErrIDRequired:
-				return NotFound(c)
+			return saveStatus(c, err)
+		}
+		c.Set(audit.ContextKey, []string{res.Key()})
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+func Updates(s services.MetricsService) func(echo.Context) error {
+	return func(c echo.Context) error {
+		var ms []model.Metrics
+		err := json.NewDecoder(c.Request().Body).Decode(&ms)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		res, err := s.SaveBatch(ms)
+		if err != nil {
+			switch {
+			case errors.Is(err, services.ErrIDRequired):
+				return c.String(http.StatusNotFound, err.Error())
+			case isValidationError(err):
+				return c.String(http.StatusBadRequest, err.Error())
 			default:
-				return BadRequest(c)
+				return InternalServerError(c, err)
 			}
 		}
+		c.Set(audit.ContextKey, audit.Names(res))
 		return c.JSON(http.StatusOK, res)
 	}
 }
@@ -120,26 +269,182 @@ func Value(s services.MetricsService) func(echo.Context) error {
 		}
 		res, err := s.Value(&m)
 		if err != nil {
-			switch err {
-			case services.ErrIDNotFound:
+			switch {
+			case errors.Is(err, services.ErrIDNotFound):
 				return c.NoContent(http.StatusNotFound)
-			default:
+			case isValidationError(err):
 				return BadRequest(c)
+			default:
+				return InternalServerError(c, err)
 			}
 		}
 		return c.JSON(http.StatusOK, res)
 	}
 }
 
-func New(service services.MetricsService) *echo.Echo {
+func History(s services.MetricsService) func(echo.Context) error {
+	return func(c echo.Context) error {
+		from, err := parseTime(c.QueryParam("from"), time.Time{})
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		to, err := parseTime(c.QueryParam("to"), time.Now())
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		step, err := parseStep(c.QueryParam("step"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		m := &model.Metrics{ID: c.Param("measureName"), MType: c.Param("measureType"), Labels: labelsFromQuery(c)}
+		points, err := s.History(m, from, to, step)
+		if err != nil {
+			switch {
+			case errors.Is(err, services.ErrIDNotFound), errors.Is(err, services.ErrIDRequired):
+				return NotFound(c)
+			case errors.Is(err, services.ErrInvalidMType):
+				return BadRequest(c)
+			case errors.Is(err, services.ErrHistoryDisabled):
+				return c.String(http.StatusNotImplemented, err.Error())
+			default:
+				return InternalServerError(c, err)
+			}
+		}
+		return c.JSON(http.StatusOK, points)
+	}
+}
+
+func ListMetrics(s services.MetricsService) func(echo.Context) error {
+	return func(c echo.Context) error {
+		q := services.ListQuery{
+			Prefix: c.QueryParam("prefix"),
+			Glob:   c.QueryParam("glob"),
+			Regex:  c.QueryParam("regex"),
+			Cursor: c.QueryParam("cursor"),
+		}
+		for _, t := range c.QueryParams()["type"] {
+			q.Types = append(q.Types, strings.Split(t, ",")...)
+		}
+		switch c.QueryParam("sort") {
+		case "", "name":
+		case "-name":
+			q.Desc = true
+		default:
+			return c.String(http.StatusBadRequest, "sort must be name or -name")
+		}
+		if limit := c.QueryParam("limit"); limit != "" {
+			var err error
+			if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit <= 0 {
+				return c.String(http.StatusBadRequest, "limit must be a positive integer")
+			}
+		}
+
+		page, err := s.ListMetrics(q)
+		if err != nil {
+			switch {
+			case errors.Is(err, services.ErrInvalidQuery),
+				errors.Is(err, services.ErrInvalidCursor),
+				errors.Is(err, services.ErrInvalidMType):
+				return c.String(http.StatusBadRequest, err.Error())
+			default:
+				return InternalServerError(c, err)
+			}
+		}
+		return c.JSON(http.StatusOK, page)
+	}
+}
+
+func Alerts(engine *services.AlertEngine) func(echo.Context) error {
+	return func(c echo.Context) error {
+		alerts := engine.Alerts()
+		if state := c.QueryParam("state"); state != "" {
+			filtered := alerts[:0]
+			for _, a := range alerts {
+				if a.State == state {
+					filtered = append(filtered, a)
+				}
+			}
+			alerts = filtered
+		}
+		return c.JSON(http.StatusOK, alerts)
+	}
+}
+
+func Silences(n *notifier.Notifier) func(echo.Context) error {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, n.Silences())
+	}
+}
+
+func CreateSilence(n *notifier.Notifier) func(echo.Context) error {
+	return func(c echo.Context) error {
+		var request struct {
+			Matcher  string `json:"matcher"`
+			Duration string `json:"duration"`
+			Comment  string `json:"comment"`
+		}
+		if err := json.NewDecoder(c.Request().Body).Decode(&request); err != nil {
+			return BadRequest(c)
+		}
+		duration, err := time.ParseDuration(request.Duration)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		silence, err := n.AddSilence(request.Matcher, duration, request.Comment)
+		if errors.Is(err, notifier.ErrInvalidSilence) {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err != nil {
+			return InternalServerError(c, err)
+		}
+		return c.JSON(http.StatusCreated, silence)
+	}
+}
+
+func ExpireSilence(n *notifier.Notifier) func(echo.Context) error {
+	return func(c echo.Context) error {
+		silence, err := n.ExpireSilence(c.Param("id"))
+		if errors.Is(err, notifier.ErrSilenceNotFound) {
+			return NotFound(c)
+		}
+		if err != nil {
+			return InternalServerError(c, err)
+		}
+		return c.JSON(http.StatusOK, silence)
+	}
+}
+
+func Ping(s services.MetricsService) func(echo.Context) error {
+	return func(c echo.Context) error {
+		if err := s.Ping(); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"status": "error", "reason": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+func New(service services.MetricsService, middlewares ...echo.MiddlewareFunc) *echo.Echo {
 	e := echo.New()
 
 	e.GET("/", ListAll(service))
 
+	requestMetrics := mymiddleware.NewRequestMetrics()
+	e.GET("/metrics", Prometheus(service))
+	e.GET("/metrics/server", ServerMetrics(requestMetrics))
+
+	e.GET("/ping", Ping(service))
+	e.GET("/healthz", Ping(service))
+	e.GET("/readyz", Ping(service))
+
 	e.GET("/value/counter/:measureName", ValueCounter(service))
 	e.GET("/value/gauge/:measureName", ValueGauge(service))
+	e.GET("/value/histogram/:measureName", ValueHistogram(service))
 	e.POST("/value/", Value(service))
 
+	e.GET("/history/:measureType/:measureName", History(service))
+
+	e.GET("/api/v1/metrics", ListMetrics(service))
+
 	e.GET("/update/*", func(c echo.Context) error { return c.NoContent(http.StatusMethodNotAllowed) })
 	e.POST("/update/:measureType/*", BadRequest)
 
@@ -148,6 +453,7 @@ func New(service services.MetricsService) *echo.Echo {
 	e.POST("/update/gauge/:measureName/:measureValue", UpdateGauge(service))
 	e.POST("/update/gauge/", NotFound)
 	e.POST("/update/", Update(service))
+	e.POST("/updates/", Updates(service))
 
 	logger, _ := zap.NewProduction()
 	defer logger.Sync()
@@ -172,7 +478,9 @@ func New(service services.MetricsService) *echo.Echo {
 			return nil
 		},
 	}))
+	e.Use(requestMetrics.Middleware)
 	e.Use(mymiddleware.Compress)
 	e.Use(mymiddleware.Decompress)
+	e.Use(middlewares...)
 	return e
 }
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	mymiddleware "github.com/javaman/go-metrics/internal/middleware"
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/javaman/go-metrics/internal/services"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	contentTypeTextFormat  = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+func SanitizeMetricName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(v)
+}
+
+func wantsOpenMetrics(c echo.Context) bool {
+	return strings.Contains(c.Request().Header.Get(echo.HeaderAccept), "application/openmetrics-text")
+}
+
+func writeExposition(c echo.Context, openMetrics bool, body string) error {
+	if openMetrics {
+		return c.Blob(http.StatusOK, contentTypeOpenMetrics, []byte(body+"# EOF\n"))
+	}
+	return c.Blob(http.StatusOK, contentTypeTextFormat, []byte(body))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := sortedKeys(labels)
+	parts := make([]string, len(names))
+	for i, k := range names {
+		parts[i] = fmt.Sprintf(`%s="%s"`, k, escapeLabelValue(labels[k]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+type familyKey struct {
+	mtype string
+	id    string
+}
+
+var familyTypeOrder = map[string]int{"gauge": 0, "counter": 1, "histogram": 2}
+
+// sampleNames lists the names a family of the type takes in the exposition.
+func sampleNames(family, mtype string, openMetrics bool) []string {
+	switch {
+	case mtype == "histogram":
+		return []string{family, family + "_bucket", family + "_sum", family + "_count"}
+	case mtype == "counter" && openMetrics:
+		return []string{family, family + "_total"}
+	}
+	return []string{family}
+}
+
+// familyNames gives every metric name and type its own family. Names that clash after sanitizing,
+// with another type or with the samples of another family get the type and, if needed, a number appended.
+// Gauges go first, then counters and histograms, each in the order of metric names.
+func familyNames(metrics []model.Metrics, openMetrics bool, logf func(string, ...any)) map[familyKey]string {
+	result := make(map[familyKey]string)
+	var keys []familyKey
+	for _, m := range metrics {
+		k := familyKey{m.MType, m.ID}
+		if _, ok := result[k]; !ok {
+			result[k] = ""
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].mtype != keys[j].mtype {
+			return familyTypeOrder[keys[i].mtype] < familyTypeOrder[keys[j].mtype]
+		}
+		return keys[i].id < keys[j].id
+	})
+
+	taken := make(map[string]bool)
+	free := func(family, mtype string) bool {
+		for _, name := range sampleNames(family, mtype, openMetrics) {
+			if taken[name] {
+				return false
+			}
+		}
+		return true
+	}
+	for _, k := range keys {
+		base := SanitizeMetricName(k.id)
+		if k.mtype == "counter" && openMetrics {
+			base = strings.TrimSuffix(base, "_total")
+		}
+		family := base
+		for n := 1; !free(family, k.mtype); n++ {
+			family = base + "_" + k.mtype
+			if n > 1 {
+				family += "_" + strconv.Itoa(n)
+			}
+		}
+		if family != base {
+			logf("%s %s is exposed as %s, %s is already taken", k.mtype, k.id, family, base)
+		}
+		for _, name := range sampleNames(family, k.mtype, openMetrics) {
+			taken[name] = true
+		}
+		result[k] = family
+	}
+	return result
+}
+
+func Prometheus(s services.MetricsService) func(echo.Context) error {
+	return func(c echo.Context) error {
+		metrics, err := s.AllMetrics(labelsFromQuery(c))
+		if err != nil {
+			return InternalServerError(c, err)
+		}
+
+		openMetrics := wantsOpenMetrics(c)
+		families := familyNames(metrics, openMetrics, c.Logger().Warnf)
+		gauges := make(map[string][]string)
+		counters := make(map[string][]string)
+		histograms := make(map[string][]string)
+		for _, m := range metrics {
+			family := families[familyKey{m.MType, m.ID}]
+			labels := formatLabels(m.Labels)
+			switch m.MType {
+			case "gauge":
+				gauges[family] = append(gauges[family], fmt.Sprintf("%s%s %s\n", family, labels, formatFloat(*m.Value)))
+			case "counter":
+				sample := family
+				if openMetrics {
+					sample = family + "_total"
+				}
+				counters[family] = append(counters[family], fmt.Sprintf("%s%s %d\n", sample, labels, *m.Delta))
+			case "histogram":
+				histograms[family] = append(histograms[family], formatHistogram(family, m.Labels, *m.Histogram))
+			}
+		}
+
+		var b strings.Builder
+		for _, family := range sortedKeys(gauges) {
+			fmt.Fprintf(&b, "# TYPE %s gauge\n", family)
+			sort.Strings(gauges[family])
+			b.WriteString(strings.Join(gauges[family], ""))
+		}
+		for _, family := range sortedKeys(counters) {
+			fmt.Fprintf(&b, "# TYPE %s counter\n", family)
+			sort.Strings(counters[family])
+			b.WriteString(strings.Join(counters[family], ""))
+		}
+		for _, family := range sortedKeys(histograms) {
+			fmt.Fprintf(&b, "# TYPE %s histogram\n", family)
+			sort.Strings(histograms[family])
+			b.WriteString(strings.Join(histograms[family], ""))
+		}
+		return writeExposition(c, openMetrics, b.String())
+	}
+}
+
+func formatHistogram(family string, labels map[string]string, h model.Histogram) string {
+	var b strings.Builder
+	bucketLabels := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		bucketLabels[k] = v
+	}
+	for i, count := range h.Cumulative() {
+		bucketLabels["le"] = "+Inf"
+		if i < len(h.Bounds) {
+			bucketLabels["le"] = formatFloat(h.Bounds[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket%s %d\n", family, formatLabels(bucketLabels), count)
+	}
+	fmt.Fprintf(&b, "%s_sum%s %s\n", family, formatLabels(labels), formatFloat(h.Sum))
+	fmt.Fprintf(&b, "%s_count%s %d\n", family, formatLabels(labels), h.Count)
+	return b.String()
+}
+
+func ServerMetrics(rm *mymiddleware.RequestMetrics) func(echo.Context) error {
+	return func(c echo.Context) error {
+		openMetrics := wantsOpenMetrics(c)
+		var requests, durations strings.Builder
+		rm.Each(func(method, path string, status int, count int64, seconds float64) {
+			labels := fmt.Sprintf(`{method="%s",path="%s",code="%d"}`, escapeLabelValue(method), escapeLabelValue(path), status)
+			fmt.Fprintf(&requests, "http_requests_total%s %d\n", labels, count)
+			fmt.Fprintf(&durations, "http_request_duration_seconds_sum%s %s\n", labels, formatFloat(seconds))
+			fmt.Fprintf(&durations, "http_request_duration_seconds_count%s %d\n", labels, count)
+		})
+
+		var b strings.Builder
+		if openMetrics {
+			b.WriteString("# TYPE http_requests counter\n")
+		} else {
+			b.WriteString("# TYPE http_requests_total counter\n")
+		}
+		b.WriteString(requests.String())
+		b.WriteString("# TYPE http_request_duration_seconds summary\n")
+		b.WriteString(durations.String())
+		return writeExposition(c, openMetrics, b.String())
+	}
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/javaman/go-metrics/internal/services"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+const streamBuffer = 256
+
+type streamMessage struct {
+	Event   string         `json:"event"`
+	Metric  *model.Metrics `json:"metric,omitempty"`
+	Dropped *int64         `json:"dropped,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+func streamFilter(c echo.Context) services.StreamFilter {
+	var f services.StreamFilter
+	for _, t := range c.QueryParams()["type"] {
+		f.Types = append(f.Types, strings.Split(t, ",")...)
+	}
+	f.Name = c.QueryParam("name")
+	return f
+}
+
+// Stream sends saved metrics as Server-Sent Events until the client disconnects or ctx is done.
+// Heartbeat events carry the number of metrics dropped because the client was too slow.
+func Stream(ctx context.Context, hub *services.Hub, heartbeat time.Duration) func(echo.Context) error {
+	return func(c echo.Context) error {
+		sub, err := hub.Subscribe(streamFilter(c), streamBuffer)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		defer sub.Close()
+
+		w := c.Response()
+		w.Header().Set(echo.HeaderContentType, "text/event-stream")
+		w.Header().Set(echo.HeaderCacheControl, "no-cache")
+		w.Header().Set(echo.HeaderConnection, "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		w.Flush()
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			var event string
+			var data any
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-c.Request().Context().Done():
+				return nil
+			case m := <-sub.C:
+				event, data = "metric", m
+			case <-ticker.C:
+				event, data = "heartbeat", map[string]int64{"dropped": sub.Dropped()}
+			}
+			encoded, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, encoded); err != nil {
+				return nil
+			}
+			w.Flush()
+		}
+	}
+}
+
+// checkOrigin lets in clients without an Origin, which are not browsers, and browsers on pages of this server.
+// websocket.Handler rejects the former.
+func checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if u.Host != r.Host {
+		return fmt.Errorf("origin %s is not allowed", origin)
+	}
+	config.Origin = u
+	return nil
+}
+
+// WebSocket sends the same events as Stream as JSON messages. The client may replace
+// its filter at any time by sending a StreamFilter.
+func WebSocket(ctx context.Context, hub *services.Hub, heartbeat time.Duration) func(echo.Context) error {
+	return func(c echo.Context) error {
+		sub, err := hub.Subscribe(streamFilter(c), streamBuffer)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		defer sub.Close()
+
+		handler := func(ws *websocket.Conn) {
+			var mu sync.Mutex
+			send := func(msg streamMessage) error {
+				mu.Lock()
+				defer mu.Unlock()
+				return websocket.JSON.Send(ws, msg)
+			}
+
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				for {
+					var data []byte
+					if err := websocket.Message.Receive(ws, &data); err != nil {
+						return
+					}
+					var f services.StreamFilter
+					err := json.Unmarshal(data, &f)
+					if err == nil {
+						err = sub.SetFilter(f)
+					}
+					if err != nil {
+						if send(streamMessage{Event: "error", Error: err.Error()}) != nil {
+							return
+						}
+					}
+				}
+			}()
+
+			ticker := time.NewTicker(heartbeat)
+			defer ticker.Stop()
+			for {
+				var msg streamMessage
+				select {
+				case <-ctx.Done():
+					return
+				case <-closed:
+					return
+				case m := <-sub.C:
+					msg = streamMessage{Event: "metric", Metric: &m}
+				case <-ticker.C:
+					dropped := sub.Dropped()
+					msg = streamMessage{Event: "heartbeat", Dropped: &dropped}
+				}
+				if send(msg) != nil {
+					return
+				}
+			}
+		}
+		websocket.Server{Handler: handler, Handshake: checkOrigin}.ServeHTTP(c.Response(), c.Request())
+		return nil
+	}
+}
@@ -0,0 +1,25 @@
+package hash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+const HeaderHashSHA256 = "HashSHA256"
+
+func Sign(key string, data []byte) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func Verify(key string, data []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(data)
+	return hmac.Equal(h.Sum(nil), expected)
+}
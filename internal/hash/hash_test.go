@@ -0,0 +1,17 @@
+package hash
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignVerify(t *testing.T) {
+	data := []byte(`{"id":"g1","type":"gauge","value":3.14}`)
+	signature := Sign("secret", data)
+
+	assert.True(t, Verify("secret", data, signature))
+	assert.False(t, Verify("other", data, signature))
+	assert.False(t, Verify("secret", []byte("tampered"), signature))
+	assert.False(t, Verify("secret", data, "not hex"))
+}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"github.com/javaman/go-metrics/internal/audit"
+	"github.com/labstack/echo/v4"
+)
+
+func Audit(a *audit.Auditor) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			if err != nil || c.Response().Status >= 300 {
+				return err
+			}
+			if names, ok := c.Get(audit.ContextKey).([]string); ok && len(names) > 0 {
+				a.Publish(audit.NewEvent(names, c.RealIP()))
+			}
+			return nil
+		}
+	}
+}
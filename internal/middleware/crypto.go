@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/javaman/go-metrics/internal/encryption"
+	"github.com/labstack/echo/v4"
+)
+
+// Decrypt requires updates to be encrypted and decrypts any request that is.
+// It must run before Decompress: the agent compresses first and encrypts the compressed body.
+func Decrypt(key *rsa.PrivateKey) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			scheme := req.Header.Get(encryption.HeaderEncryption)
+			if scheme == "" {
+				if req.Method == http.MethodPost && isUpdatePath(req.URL.Path) {
+					return echo.NewHTTPError(http.StatusBadRequest, "encrypted body required")
+				}
+				return next(c)
+			}
+			if scheme != encryption.Scheme {
+				return echo.NewHTTPError(http.StatusBadRequest, "unsupported encryption scheme")
+			}
+
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			plain, err := encryption.Decrypt(key, body)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "decryption failed")
+			}
+			req.Body = io.NopCloser(bytes.NewReader(plain))
+			req.ContentLength = int64(len(plain))
+			req.Header.Set(echo.HeaderContentLength, strconv.Itoa(len(plain)))
+			req.Header.Del(encryption.HeaderEncryption)
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/javaman/go-metrics/internal/encryption"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecrypt(t *testing.T) {
+	const body = `{"id":"g1","type":"gauge","value":3.14}`
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err = zw.Write([]byte(body))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	encrypted, err := encryption.Encrypt(&key.PublicKey, compressed.Bytes())
+	require.NoError(t, err)
+	foreign, err := encryption.Encrypt(&other.PublicKey, compressed.Bytes())
+	require.NoError(t, err)
+
+	e := echo.New()
+	e.Pre(Decrypt(key))
+	e.Use(Decompress)
+	echoBody := func(c echo.Context) error {
+		received, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, string(received))
+	}
+	e.POST("/update/", echoBody)
+	e.POST("/value/", echoBody)
+	e.GET("/", func(c echo.Context) error {
+		return c.String(http.StatusOK, "list")
+	})
+
+	testData := []struct {
+		method         string
+		path           string
+		body           []byte
+		scheme         string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{http.MethodPost, "/update/", encrypted, encryption.Scheme, http.StatusOK, body},
+		{http.MethodPost, "/update/", foreign, encryption.Scheme, http.StatusBadRequest, ""},
+		{http.MethodPost, "/update/", encrypted, "plain", http.StatusBadRequest, ""},
+		{http.MethodPost, "/update/", compressed.Bytes(), "", http.StatusBadRequest, ""},
+		{http.MethodPost, "/value/", compressed.Bytes(), "", http.StatusOK, body},
+		{http.MethodPost, "/value/", encrypted, encryption.Scheme, http.StatusOK, body},
+		{http.MethodGet, "/", nil, "", http.StatusOK, "list"},
+	}
+
+	for _, test := range testData {
+		req := httptest.NewRequest(test.method, test.path, bytes.NewReader(test.body))
+		if test.body != nil {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		if test.scheme != "" {
+			req.Header.Set(encryption.HeaderEncryption, test.scheme)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, test.expectedStatus, rec.Code)
+		if test.expectedBody != "" {
+			assert.Equal(t, test.expectedBody, strings.TrimSpace(rec.Body.String()))
+		}
+	}
+}
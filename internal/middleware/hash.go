@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/javaman/go-metrics/internal/hash"
+	"github.com/labstack/echo/v4"
+)
+
+type signingWriter struct {
+	w          http.ResponseWriter
+	body       bytes.Buffer
+	statusCode int
+}
+
+func (s *signingWriter) Header() http.Header {
+	return s.w.Header()
+}
+
+func (s *signingWriter) Write(p []byte) (int, error) {
+	return s.body.Write(p)
+}
+
+func (s *signingWriter) WriteHeader(statusCode int) {
+	s.statusCode = statusCode
+}
+
+func (s *signingWriter) flush(key string) error {
+	s.w.Header().Set(hash.HeaderHashSHA256, hash.Sign(key, s.body.Bytes()))
+	if s.statusCode != 0 {
+		s.w.WriteHeader(s.statusCode)
+	}
+	_, err := s.w.Write(s.body.Bytes())
+	return err
+}
+
+func HashSHA256(key string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			signature := c.Request().Header.Get(hash.HeaderHashSHA256)
+			if signature != "" || c.Request().Method == http.MethodPost {
+				body, err := io.ReadAll(c.Request().Body)
+				if err != nil {
+					return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+				}
+				if !hash.Verify(key, body, signature) {
+					return echo.NewHTTPError(http.StatusBadRequest, "hash mismatch")
+				}
+				c.Request().Body = io.NopCloser(bytes.NewReader(body))
+			}
+			if isStream(c.Request()) {
+				return next(c)
+			}
+
+			rw := c.Response().Writer
+			sw := &signingWriter{w: rw}
+			c.Response().Writer = sw
+			err := next(c)
+			c.Response().Writer = rw
+			if err != nil && sw.statusCode == 0 {
+				return err
+			}
+			if flushErr := sw.flush(key); flushErr != nil {
+				return flushErr
+			}
+			return err
+		}
+	}
+}
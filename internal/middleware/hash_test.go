@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/javaman/go-metrics/internal/hash"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashSHA256(t *testing.T) {
+	const key = "secret"
+	const body = `{"id":"g1","type":"gauge","value":3.14}`
+
+	e := echo.New()
+	e.Use(HashSHA256(key))
+	e.POST("/update/", func(c echo.Context) error {
+		return c.String(http.StatusOK, "done")
+	})
+	e.GET("/", func(c echo.Context) error {
+		return c.String(http.StatusOK, "list")
+	})
+
+	testData := []struct {
+		method         string
+		signature      string
+		expectedStatus int
+	}{
+		{http.MethodPost, hash.Sign(key, []byte(body)), http.StatusOK},
+		{http.MethodPost, hash.Sign("other", []byte(body)), http.StatusBadRequest},
+		{http.MethodPost, "", http.StatusBadRequest},
+		{http.MethodGet, "", http.StatusOK},
+	}
+
+	for _, test := range testData {
+		path := "/update/"
+		if test.method == http.MethodGet {
+			path = "/"
+		}
+		req := httptest.NewRequest(test.method, path, strings.NewReader(body))
+		if test.signature != "" {
+			req.Header.Set(hash.HeaderHashSHA256, test.signature)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, test.expectedStatus, rec.Code)
+		if rec.Code == http.StatusOK {
+			assert.True(t, hash.Verify(key, rec.Body.Bytes(), rec.Header().Get(hash.HeaderHashSHA256)))
+		}
+	}
+}
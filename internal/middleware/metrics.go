@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type requestKey struct {
+	method string
+	path   string
+	status int
+}
+
+type requestStat struct {
+	count   int64
+	seconds float64
+}
+
+type RequestMetrics struct {
+	mu    sync.Mutex
+	stats map[requestKey]*requestStat
+}
+
+func NewRequestMetrics() *RequestMetrics {
+	return &RequestMetrics{stats: make(map[requestKey]*requestStat)}
+}
+
+func (r *RequestMetrics) observe(method, path string, status int, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := requestKey{method, path, status}
+	stat, ok := r.stats[key]
+	if !ok {
+		stat = &requestStat{}
+		r.stats[key] = stat
+	}
+	stat.count++
+	stat.seconds += d.Seconds()
+}
+
+func (r *RequestMetrics) Each(f func(method, path string, status int, count int64, seconds float64)) {
+	r.mu.Lock()
+	keys := make([]requestKey, 0, len(r.stats))
+	stats := make(map[requestKey]requestStat, len(r.stats))
+	for k, v := range r.stats {
+		keys = append(keys, k)
+		stats[k] = *v
+	}
+	r.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		f(k.method, k.path, k.status, stats[k].count, stats[k].seconds)
+	}
+}
+
+func (r *RequestMetrics) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		status := c.Response().Status
+		if err != nil && !c.Response().Committed {
+			status = http.StatusInternalServerError
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			}
+		}
+		r.observe(c.Request().Method, c.Path(), status, time.Since(start))
+		return err
+	}
+}
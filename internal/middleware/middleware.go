@@ -90,9 +90,31 @@ func (c *compressWriter) WriteHeader(statusCode int) {
 func (c *compressWriter) Close() error {
 	return c.zw.Close()
 }
+
+func (c *compressWriter) Flush() {
+	c.zw.Flush()
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func isStreamPath(path string) bool {
+	return path == "/stream" || path == "/ws"
+}
+
+// isStream reports whether the response is sent incrementally and so cannot be buffered.
+// Streams are told by route, clients don't have to ask for them in Accept.
+func isStream(r *http.Request) bool {
+	return isWebSocket(r) || isStreamPath(r.URL.Path)
+}
+
 func Compress(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		if strings.Contains(c.Request().Header.Get("Accept-Encoding"), contentEncodingGzip) {
+		if strings.Contains(c.Request().Header.Get("Accept-Encoding"), contentEncodingGzip) && !isWebSocket(c.Request()) {
 			rw := c.Response().Writer
 			cw := newCompressWriter(rw)
 			cw.zw.Reset(rw)
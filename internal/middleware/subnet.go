@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+func isUpdatePath(path string) bool {
+	return strings.HasPrefix(path, "/update/") || path == "/updates/"
+}
+
+// TrustedSubnet accepts updates only from agents whose X-Real-IP belongs to subnet.
+func TrustedSubnet(subnet *net.IPNet) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !isUpdatePath(c.Request().URL.Path) {
+				return next(c)
+			}
+			ip := net.ParseIP(c.Request().Header.Get(echo.HeaderXRealIP))
+			if ip == nil || !subnet.Contains(ip) {
+				return echo.NewHTTPError(http.StatusForbidden, "untrusted address")
+			}
+			return next(c)
+		}
+	}
+}
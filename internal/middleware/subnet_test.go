@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedSubnet(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+
+	e := echo.New()
+	e.Use(TrustedSubnet(subnet))
+	ok := func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}
+	e.POST("/update/gauge/:name/:value", ok)
+	e.POST("/updates/", ok)
+	e.POST("/value/", ok)
+	e.GET("/", ok)
+
+	testData := []struct {
+		method         string
+		path           string
+		realIP         string
+		expectedStatus int
+	}{
+		{http.MethodPost, "/update/gauge/g1/1", "192.168.1.10", http.StatusOK},
+		{http.MethodPost, "/updates/", "192.168.1.10", http.StatusOK},
+		{http.MethodPost, "/update/gauge/g1/1", "10.0.0.1", http.StatusForbidden},
+		{http.MethodPost, "/updates/", "", http.StatusForbidden},
+		{http.MethodPost, "/updates/", "not an ip", http.StatusForbidden},
+		{http.MethodPost, "/value/", "10.0.0.1", http.StatusOK},
+		{http.MethodGet, "/", "", http.StatusOK},
+	}
+
+	for _, test := range testData {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.realIP != "" {
+			req.Header.Set(echo.HeaderXRealIP, test.realIP)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, test.expectedStatus, rec.Code, test.path)
+	}
+}
@@ -1,8 +1,255 @@
 package model
 
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidKey       = errors.New("invalid metric key")
+	ErrInvalidHistogram = errors.New("invalid histogram")
+)
+
 type Metrics struct {
-	ID    string   `json:"id"`
-	MType string   `json:"type"`
-	Delta *int64   `json:"delta,omitempty"`
-	Value *float64 `json:"value,omitempty"`
+	ID        string            `json:"id"`
+	MType     string            `json:"type"`
+	Delta     *int64            `json:"delta,omitempty"`
+	Value     *float64          `json:"value,omitempty"`
+	Histogram *Histogram        `json:"histogram,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Timestamp *time.Time        `json:"timestamp,omitempty"`
+	Stale     bool              `json:"stale,omitempty"`
+}
+
+// Histogram keeps per-bucket (not cumulative) counts, Counts has one more
+// element than Bounds for the implicit +Inf bucket.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    float64   `json:"sum"`
+	Count  uint64    `json:"count"`
+}
+
+func NewHistogram(bounds []float64) Histogram {
+	return Histogram{
+		Bounds: append([]float64(nil), bounds...),
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.Counts[sort.SearchFloat64s(h.Bounds, v)]++
+	h.Sum += v
+	h.Count++
+}
+
+func (h Histogram) Validate() error {
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return ErrInvalidHistogram
+	}
+	for i, b := range h.Bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) || (i > 0 && b <= h.Bounds[i-1]) {
+			return ErrInvalidHistogram
+		}
+	}
+	var count uint64
+	for _, c := range h.Counts {
+		count += c
+	}
+	if count != h.Count || math.IsNaN(h.Sum) {
+		return ErrInvalidHistogram
+	}
+	return nil
+}
+
+func (h Histogram) Clone() Histogram {
+	return Histogram{
+		Bounds: append([]float64(nil), h.Bounds...),
+		Counts: append([]uint64(nil), h.Counts...),
+		Sum:    h.Sum,
+		Count:  h.Count,
+	}
+}
+
+func (h Histogram) SameBounds(other Histogram) bool {
+	if len(h.Bounds) != len(other.Bounds) {
+		return false
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != other.Bounds[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge adds delta observations to h. A delta with different bounds means the
+// reporter was reconfigured, so it starts the histogram over.
+func (h Histogram) Merge(delta Histogram) Histogram {
+	if !h.SameBounds(delta) {
+		return delta.Clone()
+	}
+	result := h.Clone()
+	for i, c := range delta.Counts {
+		result.Counts[i] += c
+	}
+	result.Sum += delta.Sum
+	result.Count += delta.Count
+	return result
+}
+
+// Cumulative returns bucket counts as "less or equal" totals, the last one is +Inf.
+func (h Histogram) Cumulative() []uint64 {
+	result := make([]uint64, len(h.Counts))
+	var total uint64
+	for i, c := range h.Counts {
+		total += c
+		result[i] = total
+	}
+	return result
+}
+
+func (m *Metrics) Key() string {
+	return MetricKey(m.ID, m.Labels)
+}
+
+func ValidLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func MetricKey(id string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return id
+	}
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(id)
+	b.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[k]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func ParseMetricKey(key string) (string, map[string]string, error) {
+	idx := strings.IndexByte(key, '{')
+	if idx < 0 {
+		return key, nil, nil
+	}
+	id, rest := key[:idx], key[idx+1:]
+	labels := make(map[string]string)
+	for {
+		if rest == "}" {
+			return id, labels, nil
+		}
+		name, value, found := strings.Cut(rest, "=")
+		if !found || !ValidLabelName(name) {
+			return "", nil, ErrInvalidKey
+		}
+		quoted, err := strconv.QuotedPrefix(value)
+		if err != nil {
+			return "", nil, ErrInvalidKey
+		}
+		labels[name], _ = strconv.Unquote(quoted)
+		rest = value[len(quoted):]
+		if strings.HasPrefix(rest, ",") {
+			rest = rest[1:]
+		} else if rest != "}" {
+			return "", nil, ErrInvalidKey
+		}
+	}
+}
+
+func MatchLabels(labels, filter map[string]string) bool {
+	for k, v := range filter {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Point is a stored value, or the average of a downsampled interval starting at Time.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Min   *float64  `json:"min,omitempty"`
+	Max   *float64  `json:"max,omitempty"`
+	Count int       `json:"count,omitempty"`
+}
+
+// Downsample groups time-ordered points into step-long intervals counted from start.
+func Downsample(points []Point, start time.Time, step time.Duration) []Point {
+	var result []Point
+	var sum float64
+	for _, p := range points {
+		bucket := start.Add(p.Time.Sub(start).Truncate(step))
+		last := len(result) - 1
+		if last < 0 || !result[last].Time.Equal(bucket) {
+			lo, hi := p.Value, p.Value
+			result = append(result, Point{Time: bucket, Min: &lo, Max: &hi})
+			last++
+			sum = 0
+		}
+		r := &result[last]
+		sum += p.Value
+		r.Count++
+		r.Value = sum / float64(r.Count)
+		if p.Value < *r.Min {
+			*r.Min = p.Value
+		}
+		if p.Value > *r.Max {
+			*r.Max = p.Value
+		}
+	}
+	return result
+}
+
+const (
+	AlertInactive = "inactive"
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Metric      string            `json:"metric"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	State       string            `json:"state"`
+	Value       *float64          `json:"value,omitempty"`
+	ActiveSince *time.Time        `json:"active_since,omitempty"`
+	FiredAt     *time.Time        `json:"fired_at,omitempty"`
+	ResolvedAt  *time.Time        `json:"resolved_at,omitempty"`
+}
+
+// Key identifies the alert of one rule for one series.
+func (a *Alert) Key() string {
+	return MetricKey(a.Rule, a.Labels)
 }
@@ -0,0 +1,99 @@
+package model
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricKey(t *testing.T) {
+	assert.Equal(t, "Alloc", MetricKey("Alloc", nil))
+	assert.Equal(t, `Alloc{host="h1",instance="i\"1"}`, MetricKey("Alloc", map[string]string{"instance": `i"1`, "host": "h1"}))
+}
+
+func TestParseMetricKey(t *testing.T) {
+	testData := []map[string]string{
+		nil,
+		{"host": "h1"},
+		{"host": "h,1}", "instance": `i"1=`, "empty": ""},
+	}
+	for _, labels := range testData {
+		id, parsed, err := ParseMetricKey(MetricKey("Alloc", labels))
+		assert.NoError(t, err)
+		assert.Equal(t, "Alloc", id)
+		if len(labels) == 0 {
+			assert.Empty(t, parsed)
+		} else {
+			assert.Equal(t, labels, parsed)
+		}
+	}
+
+	for _, key := range []string{`Alloc{`, `Alloc{host}`, `Alloc{host="h1"`, `Alloc{host="h1"x}`, `Alloc{1st="h1"}`} {
+		_, _, err := ParseMetricKey(key)
+		assert.ErrorIs(t, err, ErrInvalidKey, key)
+	}
+}
+
+func TestMatchLabels(t *testing.T) {
+	labels := map[string]string{"host": "h1", "instance": "i1"}
+	assert.True(t, MatchLabels(labels, nil))
+	assert.True(t, MatchLabels(labels, map[string]string{"host": "h1"}))
+	assert.False(t, MatchLabels(labels, map[string]string{"host": "h2"}))
+	assert.False(t, MatchLabels(nil, map[string]string{"host": "h1"}))
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		h.Observe(v)
+	}
+	assert.NoError(t, h.Validate())
+	assert.Equal(t, []uint64{2, 1, 1}, h.Counts)
+	assert.Equal(t, []uint64{2, 3, 4}, h.Cumulative())
+	assert.Equal(t, uint64(4), h.Count)
+	assert.InDelta(t, 2.65, h.Sum, 1e-9)
+
+	merged := h.Merge(h)
+	assert.Equal(t, []uint64{4, 2, 2}, merged.Counts)
+	assert.Equal(t, uint64(8), merged.Count)
+	assert.Equal(t, []uint64{2, 1, 1}, h.Counts)
+
+	other := NewHistogram([]float64{1})
+	other.Observe(3)
+	assert.Equal(t, other, h.Merge(other))
+}
+
+func TestHistogramValidate(t *testing.T) {
+	invalid := []Histogram{
+		{Bounds: []float64{1}, Counts: []uint64{1}, Count: 1},
+		{Bounds: []float64{1, 1}, Counts: []uint64{0, 0, 0}},
+		{Bounds: []float64{1}, Counts: []uint64{1, 1}, Count: 1},
+		{Bounds: []float64{math.Inf(1)}, Counts: []uint64{0, 0}},
+	}
+	for _, h := range invalid {
+		assert.ErrorIs(t, h.Validate(), ErrInvalidHistogram)
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	start := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	var points []Point
+	for i, v := range []float64{1, 3, 2, 10, 20} {
+		points = append(points, Point{Time: start.Add(time.Duration(i*20) * time.Second), Value: v})
+	}
+
+	result := Downsample(points, start, time.Minute)
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, start, result[0].Time)
+	assert.Equal(t, 2.0, result[0].Value)
+	assert.Equal(t, 1.0, *result[0].Min)
+	assert.Equal(t, 3.0, *result[0].Max)
+	assert.Equal(t, 3, result[0].Count)
+	assert.Equal(t, start.Add(time.Minute), result[1].Time)
+	assert.Equal(t, 15.0, result[1].Value)
+	assert.Equal(t, 2, result[1].Count)
+
+	assert.Empty(t, Downsample(nil, start, time.Minute))
+}
@@ -0,0 +1,324 @@
+package notifier
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/javaman/go-metrics/internal/retry"
+)
+
+const (
+	postTimeout = 5 * time.Second
+	// silenceRetention is how long ended silences stay listed before they are dropped
+	silenceRetention = 24 * time.Hour
+)
+
+var (
+	ErrSilenceNotFound = errors.New("silence not found")
+	ErrInvalidSilence  = errors.New("invalid silence")
+)
+
+// Silence mutes notifications for alerts whose metric name matches Matcher (a path.Match pattern).
+type Silence struct {
+	ID       string    `json:"id"`
+	Matcher  string    `json:"matcher"`
+	Comment  string    `json:"comment,omitempty"`
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+}
+
+func (s Silence) Active(at time.Time) bool {
+	return !at.Before(s.StartsAt) && at.Before(s.EndsAt)
+}
+
+func (s Silence) Matches(metric string) bool {
+	ok, _ := path.Match(s.Matcher, metric)
+	return ok
+}
+
+// Notification is the JSON body posted to webhooks: all alerts of one metric that changed or are due for repeat.
+type Notification struct {
+	Group  string        `json:"group"`
+	Status string        `json:"status"`
+	Alerts []model.Alert `json:"alerts"`
+}
+
+type delivery struct {
+	version int
+	at      time.Time
+}
+
+type group struct {
+	alerts  map[string]model.Alert
+	version int
+	// sent holds the last delivery to each webhook, so one failing webhook doesn't cause repeats on the others
+	sent map[string]delivery
+}
+
+func (g *group) firing() bool {
+	for _, a := range g.alerts {
+		if a.State == model.AlertFiring {
+			return true
+		}
+	}
+	return false
+}
+
+type Notifier struct {
+	mu             sync.Mutex
+	client         *resty.Client
+	urls           []string
+	retryDelays    []time.Duration
+	repeatInterval time.Duration
+	now            func() time.Time
+	groups         map[string]*group
+	silences       map[string]Silence
+}
+
+func New(urls []string, retryDelays []time.Duration, repeatInterval time.Duration) *Notifier {
+	return &Notifier{
+		client:         resty.New().SetTimeout(postTimeout),
+		urls:           urls,
+		retryDelays:    retryDelays,
+		repeatInterval: repeatInterval,
+		now:            time.Now,
+		groups:         make(map[string]*group),
+		silences:       make(map[string]Silence),
+	}
+}
+
+// Notify queues an alert state change; it is sent with its group on the next Flush.
+func (n *Notifier) Notify(a model.Alert) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	g, ok := n.groups[a.Metric]
+	if !ok {
+		g = &group{alerts: make(map[string]model.Alert), sent: make(map[string]delivery)}
+		n.groups[a.Metric] = g
+	}
+	g.alerts[a.Key()] = a
+	g.version++
+}
+
+func (n *Notifier) silenced(metric string, at time.Time) bool {
+	for _, s := range n.silences {
+		if s.Active(at) && s.Matches(metric) {
+			return true
+		}
+	}
+	return false
+}
+
+type pending struct {
+	name         string
+	version      int
+	urls         []string
+	notification Notification
+}
+
+func (n *Notifier) due(now time.Time) []pending {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for id, s := range n.silences {
+		if now.Sub(s.EndsAt) >= silenceRetention {
+			delete(n.silences, id)
+		}
+	}
+
+	var result []pending
+	for name, g := range n.groups {
+		if n.silenced(name, now) {
+			for key, a := range g.alerts {
+				if a.State == model.AlertResolved {
+					delete(g.alerts, key)
+				}
+			}
+			if len(g.alerts) == 0 {
+				delete(n.groups, name)
+			}
+			continue
+		}
+		var urls []string
+		for _, url := range n.urls {
+			d := g.sent[url]
+			changed := g.version != d.version
+			repeat := g.firing() && now.Sub(d.at) >= n.repeatInterval
+			if changed || repeat {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) == 0 {
+			continue
+		}
+		notification := Notification{Group: name, Status: model.AlertResolved}
+		if g.firing() {
+			notification.Status = model.AlertFiring
+		}
+		for _, a := range g.alerts {
+			notification.Alerts = append(notification.Alerts, a)
+		}
+		sort.Slice(notification.Alerts, func(i, j int) bool {
+			return notification.Alerts[i].Key() < notification.Alerts[j].Key()
+		})
+		result = append(result, pending{name, g.version, urls, notification})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+	return result
+}
+
+func (n *Notifier) sent(p pending, url string, at time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	g, ok := n.groups[p.name]
+	if !ok {
+		return
+	}
+	g.sent[url] = delivery{p.version, at}
+	// resolved alerts are kept until every webhook got them
+	for _, webhook := range n.urls {
+		if g.sent[webhook].version != p.version {
+			return
+		}
+	}
+	for _, a := range p.notification.Alerts {
+		if current := g.alerts[a.Key()]; a.State == model.AlertResolved && current.State == model.AlertResolved {
+			delete(g.alerts, a.Key())
+		}
+	}
+	if len(g.alerts) == 0 {
+		delete(n.groups, p.name)
+	}
+}
+
+type statusError struct {
+	url  string
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: status %d", e.url, e.code)
+}
+
+func isRetriable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= http.StatusInternalServerError || se.code == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (n *Notifier) post(ctx context.Context, url string, notification Notification) error {
+	return retry.Do(ctx, n.retryDelays, isRetriable, func() error {
+		resp, err := n.client.R().SetContext(ctx).SetBody(notification).Post(url)
+		if err != nil {
+			return err
+		}
+		if resp.IsError() {
+			return &statusError{url, resp.StatusCode()}
+		}
+		return nil
+	})
+}
+
+// Flush posts every group that changed since it was last sent to a webhook, or is still firing after
+// the repeat interval, to that webhook. Webhooks that failed get the group again on the next Flush.
+func (n *Notifier) Flush(ctx context.Context) error {
+	now := n.now()
+	var errs []error
+	for _, p := range n.due(now) {
+		for _, url := range p.urls {
+			if err := n.post(ctx, url, p.notification); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			n.sent(p, url, now)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n *Notifier) AddSilence(matcher string, duration time.Duration, comment string) (Silence, error) {
+	if _, err := path.Match(matcher, ""); err != nil || matcher == "" || duration <= 0 {
+		return Silence{}, ErrInvalidSilence
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Silence{}, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.now()
+	s := Silence{
+		ID:       hex.EncodeToString(id),
+		Matcher:  matcher,
+		Comment:  comment,
+		StartsAt: now,
+		EndsAt:   now.Add(duration),
+	}
+	n.silences[s.ID] = s
+	return s, nil
+}
+
+func (n *Notifier) ExpireSilence(id string) (Silence, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	s, ok := n.silences[id]
+	if !ok {
+		return Silence{}, ErrSilenceNotFound
+	}
+	if now := n.now(); s.EndsAt.After(now) {
+		s.EndsAt = now
+		n.silences[id] = s
+	}
+	return s, nil
+}
+
+func (n *Notifier) Silences() []Silence {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	result := make([]Silence, 0, len(n.silences))
+	for _, s := range n.silences {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].StartsAt.Before(result[j].StartsAt) })
+	return result
+}
+
+func (n *Notifier) RunInBackground(ctx context.Context, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := n.Flush(ctx); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}()
+	return done
+}
@@ -0,0 +1,202 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type webhook struct {
+	mu       sync.Mutex
+	received []Notification
+	failures int
+}
+
+func (w *webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failures > 0 {
+		w.failures--
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var n Notification
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.received = append(w.received, n)
+}
+
+func (w *webhook) take() []Notification {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	result := w.received
+	w.received = nil
+	return result
+}
+
+func alert(rule, metric, state string) model.Alert {
+	return model.Alert{Rule: rule, Metric: metric, State: state}
+}
+
+func TestNotifierGroupsAndRepeats(t *testing.T) {
+	hook := &webhook{}
+	ts := httptest.NewServer(hook)
+	defer ts.Close()
+
+	n := New([]string{ts.URL}, nil, time.Hour)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	n.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	n.Notify(alert("HighHeap", "HeapAlloc", model.AlertFiring))
+	n.Notify(alert("HeapGrowing", "HeapAlloc", model.AlertFiring))
+	labelled := alert("HighHeap", "HeapAlloc", model.AlertFiring)
+	labelled.Labels = map[string]string{"host": "a"}
+	n.Notify(labelled)
+	n.Notify(alert("PollStuck", "PollCount", model.AlertFiring))
+	require.NoError(t, n.Flush(ctx))
+
+	received := hook.take()
+	require.Equal(t, 2, len(received))
+	assert.Equal(t, "HeapAlloc", received[0].Group)
+	assert.Equal(t, model.AlertFiring, received[0].Status)
+	assert.Equal(t, []model.Alert{alert("HeapGrowing", "HeapAlloc", model.AlertFiring), alert("HighHeap", "HeapAlloc", model.AlertFiring), labelled}, received[0].Alerts)
+	assert.Equal(t, "PollCount", received[1].Group)
+
+	require.NoError(t, n.Flush(ctx))
+	assert.Empty(t, hook.take())
+
+	n.Notify(alert("PollStuck", "PollCount", model.AlertResolved))
+	now = now.Add(time.Minute)
+	require.NoError(t, n.Flush(ctx))
+	received = hook.take()
+	require.Equal(t, 1, len(received))
+	assert.Equal(t, model.AlertResolved, received[0].Status)
+
+	now = now.Add(time.Hour)
+	require.NoError(t, n.Flush(ctx))
+	received = hook.take()
+	require.Equal(t, 1, len(received))
+	assert.Equal(t, "HeapAlloc", received[0].Group)
+}
+
+func TestNotifierRetries(t *testing.T) {
+	hook := &webhook{failures: 2}
+	ts := httptest.NewServer(hook)
+	defer ts.Close()
+
+	n := New([]string{ts.URL}, []time.Duration{time.Millisecond}, time.Hour)
+	n.Notify(alert("HighHeap", "HeapAlloc", model.AlertFiring))
+
+	assert.Error(t, n.Flush(context.Background()))
+	assert.Empty(t, hook.take())
+
+	require.NoError(t, n.Flush(context.Background()))
+	assert.Equal(t, 1, len(hook.take()))
+}
+
+func TestNotifierDeliversPerWebhook(t *testing.T) {
+	healthy := &webhook{}
+	ts := httptest.NewServer(healthy)
+	defer ts.Close()
+	failing := &webhook{failures: 1}
+	tsFailing := httptest.NewServer(failing)
+	defer tsFailing.Close()
+
+	n := New([]string{ts.URL, tsFailing.URL}, nil, time.Hour)
+	n.Notify(alert("PollStuck", "PollCount", model.AlertResolved))
+
+	assert.Error(t, n.Flush(context.Background()))
+	assert.Equal(t, 1, len(healthy.take()))
+	assert.Empty(t, failing.take())
+
+	require.NoError(t, n.Flush(context.Background()))
+	assert.Empty(t, healthy.take())
+	assert.Equal(t, 1, len(failing.take()))
+
+	require.NoError(t, n.Flush(context.Background()))
+	assert.Empty(t, healthy.take())
+	assert.Empty(t, failing.take())
+	assert.Empty(t, n.groups)
+}
+
+func TestSilences(t *testing.T) {
+	hook := &webhook{}
+	ts := httptest.NewServer(hook)
+	defer ts.Close()
+
+	n := New([]string{ts.URL}, nil, time.Hour)
+	ctx := context.Background()
+
+	_, err := n.AddSilence("[", time.Hour, "")
+	assert.ErrorIs(t, err, ErrInvalidSilence)
+	_, err = n.AddSilence("Heap*", 0, "")
+	assert.ErrorIs(t, err, ErrInvalidSilence)
+
+	s, err := n.AddSilence("Heap*", time.Hour, "deploy")
+	require.NoError(t, err)
+	assert.True(t, s.Matches("HeapAlloc"))
+	assert.False(t, s.Matches("PollCount"))
+	assert.Equal(t, []Silence{s}, n.Silences())
+
+	n.Notify(alert("HighHeap", "HeapAlloc", model.AlertFiring))
+	n.Notify(alert("PollStuck", "PollCount", model.AlertFiring))
+	require.NoError(t, n.Flush(ctx))
+	received := hook.take()
+	require.Equal(t, 1, len(received))
+	assert.Equal(t, "PollCount", received[0].Group)
+
+	expired, err := n.ExpireSilence(s.ID)
+	require.NoError(t, err)
+	assert.False(t, expired.Active(time.Now()))
+	_, err = n.ExpireSilence("missing")
+	assert.ErrorIs(t, err, ErrSilenceNotFound)
+
+	require.NoError(t, n.Flush(ctx))
+	received = hook.take()
+	require.Equal(t, 1, len(received))
+	assert.Equal(t, "HeapAlloc", received[0].Group)
+}
+
+func TestSilencesPruned(t *testing.T) {
+	n := New(nil, nil, time.Hour)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	n.now = func() time.Time { return now }
+
+	s, err := n.AddSilence("Heap*", time.Hour, "")
+	require.NoError(t, err)
+	expired, err := n.AddSilence("Poll*", time.Hour, "")
+	require.NoError(t, err)
+	_, err = n.ExpireSilence(expired.ID)
+	require.NoError(t, err)
+
+	now = now.Add(time.Hour)
+	require.NoError(t, n.Flush(context.Background()))
+	assert.Equal(t, 2, len(n.Silences()))
+
+	now = now.Add(silenceRetention - time.Hour)
+	require.NoError(t, n.Flush(context.Background()))
+	assert.Equal(t, []string{s.ID}, silenceIDs(n.Silences()))
+
+	now = now.Add(time.Hour)
+	require.NoError(t, n.Flush(context.Background()))
+	assert.Empty(t, n.Silences())
+}
+
+func silenceIDs(silences []Silence) []string {
+	var result []string
+	for _, s := range silences {
+		result = append(result, s.ID)
+	}
+	return result
+}
@@ -0,0 +1,69 @@
+package proto
+
+import (
+	"github.com/javaman/go-metrics/internal/model"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func FromModel(m *model.Metrics) *Metric {
+	result := &Metric{
+		Id:     m.ID,
+		Type:   m.MType,
+		Delta:  m.Delta,
+		Value:  m.Value,
+		Labels: m.Labels,
+		Stale:  m.Stale,
+	}
+	if m.Histogram != nil {
+		result.Histogram = &Histogram{
+			Bounds: m.Histogram.Bounds,
+			Counts: m.Histogram.Counts,
+			Sum:    m.Histogram.Sum,
+			Count:  m.Histogram.Count,
+		}
+	}
+	if m.Timestamp != nil {
+		result.Timestamp = timestamppb.New(*m.Timestamp)
+	}
+	return result
+}
+
+func ToModel(m *Metric) *model.Metrics {
+	result := &model.Metrics{
+		ID:     m.GetId(),
+		MType:  m.GetType(),
+		Delta:  m.Delta,
+		Value:  m.Value,
+		Labels: m.GetLabels(),
+		Stale:  m.GetStale(),
+	}
+	if h := m.GetHistogram(); h != nil {
+		result.Histogram = &model.Histogram{
+			Bounds: h.GetBounds(),
+			Counts: h.GetCounts(),
+			Sum:    h.GetSum(),
+			Count:  h.GetCount(),
+		}
+	}
+	if m.GetTimestamp() != nil {
+		t := m.GetTimestamp().AsTime()
+		result.Timestamp = &t
+	}
+	return result
+}
+
+func FromModelBatch(ms []model.Metrics) *MetricsBatch {
+	result := &MetricsBatch{Metrics: make([]*Metric, len(ms))}
+	for i := range ms {
+		result.Metrics[i] = FromModel(&ms[i])
+	}
+	return result
+}
+
+func ToModelBatch(b *MetricsBatch) []model.Metrics {
+	result := make([]model.Metrics, len(b.GetMetrics()))
+	for i, m := range b.GetMetrics() {
+		result[i] = *ToModel(m)
+	}
+	return result
+}
@@ -0,0 +1,4 @@
+package proto
+
+// MetadataRealIP carries the agent address checked against the trusted subnet, like the X-Real-IP header.
+const MetadataRealIP = "x-real-ip"
@@ -0,0 +1,292 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: metrics.proto
+
+package proto
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Metrics_Update_FullMethodName      = "/metrics.Metrics/Update"
+	Metrics_UpdateBatch_FullMethodName = "/metrics.Metrics/UpdateBatch"
+	Metrics_Value_FullMethodName       = "/metrics.Metrics/Value"
+	Metrics_List_FullMethodName        = "/metrics.Metrics/List"
+	Metrics_Push_FullMethodName        = "/metrics.Metrics/Push"
+)
+
+// MetricsClient is the client API for Metrics service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MetricsClient interface {
+	Update(ctx context.Context, in *Metric, opts ...grpc.CallOption) (*Metric, error)
+	UpdateBatch(ctx context.Context, in *MetricsBatch, opts ...grpc.CallOption) (*MetricsBatch, error)
+	Value(ctx context.Context, in *Metric, opts ...grpc.CallOption) (*Metric, error)
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*MetricsBatch, error)
+	Push(ctx context.Context, opts ...grpc.CallOption) (Metrics_PushClient, error)
+}
+
+type metricsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMetricsClient(cc grpc.ClientConnInterface) MetricsClient {
+	return &metricsClient{cc}
+}
+
+func (c *metricsClient) Update(ctx context.Context, in *Metric, opts ...grpc.CallOption) (*Metric, error) {
+	out := new(Metric)
+	err := c.cc.Invoke(ctx, Metrics_Update_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsClient) UpdateBatch(ctx context.Context, in *MetricsBatch, opts ...grpc.CallOption) (*MetricsBatch, error) {
+	out := new(MetricsBatch)
+	err := c.cc.Invoke(ctx, Metrics_UpdateBatch_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsClient) Value(ctx context.Context, in *Metric, opts ...grpc.CallOption) (*Metric, error) {
+	out := new(Metric)
+	err := c.cc.Invoke(ctx, Metrics_Value_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*MetricsBatch, error) {
+	out := new(MetricsBatch)
+	err := c.cc.Invoke(ctx, Metrics_List_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsClient) Push(ctx context.Context, opts ...grpc.CallOption) (Metrics_PushClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Metrics_ServiceDesc.Streams[0], Metrics_Push_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metricsPushClient{stream}
+	return x, nil
+}
+
+type Metrics_PushClient interface {
+	Send(*Metric) error
+	CloseAndRecv() (*PushResponse, error)
+	grpc.ClientStream
+}
+
+type metricsPushClient struct {
+	grpc.ClientStream
+}
+
+func (x *metricsPushClient) Send(m *Metric) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *metricsPushClient) CloseAndRecv() (*PushResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(PushResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MetricsServer is the server API for Metrics service.
+// All implementations must embed UnimplementedMetricsServer
+// for forward compatibility
+type MetricsServer interface {
+	Update(context.Context, *Metric) (*Metric, error)
+	UpdateBatch(context.Context, *MetricsBatch) (*MetricsBatch, error)
+	Value(context.Context, *Metric) (*Metric, error)
+	List(context.Context, *ListRequest) (*MetricsBatch, error)
+	Push(Metrics_PushServer) error
+	mustEmbedUnimplementedMetricsServer()
+}
+
+// UnimplementedMetricsServer must be embedded to have forward compatible implementations.
+type UnimplementedMetricsServer struct {
+}
+
+func (UnimplementedMetricsServer) Update(context.Context, *Metric) (*Metric, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Update not implemented")
+}
+func (UnimplementedMetricsServer) UpdateBatch(context.Context, *MetricsBatch) (*MetricsBatch, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateBatch not implemented")
+}
+func (UnimplementedMetricsServer) Value(context.Context, *Metric) (*Metric, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Value not implemented")
+}
+func (UnimplementedMetricsServer) List(context.Context, *ListRequest) (*MetricsBatch, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedMetricsServer) Push(Metrics_PushServer) error {
+	return status.Errorf(codes.Unimplemented, "method Push not implemented")
+}
+func (UnimplementedMetricsServer) mustEmbedUnimplementedMetricsServer() {}
+
+// UnsafeMetricsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MetricsServer will
+// result in compilation errors.
+type UnsafeMetricsServer interface {
+	mustEmbedUnimplementedMetricsServer()
+}
+
+func RegisterMetricsServer(s grpc.ServiceRegistrar, srv MetricsServer) {
+	s.RegisterService(&Metrics_ServiceDesc, srv)
+}
+
+func _Metrics_Update_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Metric)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsServer).Update(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Metrics_Update_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsServer).Update(ctx, req.(*Metric))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Metrics_UpdateBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MetricsBatch)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsServer).UpdateBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Metrics_UpdateBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsServer).UpdateBatch(ctx, req.(*MetricsBatch))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Metrics_Value_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Metric)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsServer).Value(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Metrics_Value_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsServer).Value(ctx, req.(*Metric))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Metrics_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Metrics_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Metrics_Push_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MetricsServer).Push(&metricsPushServer{stream})
+}
+
+type Metrics_PushServer interface {
+	SendAndClose(*PushResponse) error
+	Recv() (*Metric, error)
+	grpc.ServerStream
+}
+
+type metricsPushServer struct {
+	grpc.ServerStream
+}
+
+func (x *metricsPushServer) SendAndClose(m *PushResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *metricsPushServer) Recv() (*Metric, error) {
+	m := new(Metric)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Metrics_ServiceDesc is the grpc.ServiceDesc for Metrics service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Metrics_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "metrics.Metrics",
+	HandlerType: (*MetricsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Update",
+			Handler:    _Metrics_Update_Handler,
+		},
+		{
+			MethodName: "UpdateBatch",
+			Handler:    _Metrics_UpdateBatch_Handler,
+		},
+		{
+			MethodName: "Value",
+			Handler:    _Metrics_Value_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _Metrics_List_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Push",
+			Handler:       _Metrics_Push_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "metrics.proto",
+}
@@ -0,0 +1,48 @@
+package proto
+
+import (
+	"strings"
+
+	"github.com/javaman/go-metrics/internal/hash"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+var MetadataHashSHA256 = strings.ToLower(hash.HeaderHashSHA256)
+
+func marshalDeterministic(m gproto.Message) ([]byte, error) {
+	return gproto.MarshalOptions{Deterministic: true}.Marshal(m)
+}
+
+func Sign(key string, m gproto.Message) (string, error) {
+	data, err := marshalDeterministic(m)
+	if err != nil {
+		return "", err
+	}
+	return hash.Sign(key, data), nil
+}
+
+func Verify(key string, m gproto.Message, signature string) (bool, error) {
+	data, err := marshalDeterministic(m)
+	if err != nil {
+		return false, err
+	}
+	return hash.Verify(key, data, signature), nil
+}
+
+// SignMetric sets the hash of a streamed metric, streams can't carry a signature per message in metadata.
+func SignMetric(key string, m *Metric) error {
+	m.Hash = ""
+	signature, err := Sign(key, m)
+	if err != nil {
+		return err
+	}
+	m.Hash = signature
+	return nil
+}
+
+// VerifyMetric checks the hash set by SignMetric and clears it.
+func VerifyMetric(key string, m *Metric) (bool, error) {
+	signature := m.Hash
+	m.Hash = ""
+	return Verify(key, m, signature)
+}
@@ -0,0 +1,131 @@
+package repository
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/javaman/go-metrics/internal/model"
+)
+
+var ErrHistoryDisabled = errors.New("history is disabled")
+
+type series struct {
+	points []model.Point
+	start  int
+}
+
+func (s *series) add(p model.Point, size int) {
+	if len(s.points) < size {
+		s.points = append(s.points, p)
+		return
+	}
+	s.points[s.start] = p
+	s.start = (s.start + 1) % len(s.points)
+}
+
+func (s *series) between(from, to time.Time) []model.Point {
+	var result []model.Point
+	for i := range s.points {
+		p := s.points[(s.start+i)%len(s.points)]
+		if !p.Time.Before(from) && !p.Time.After(to) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+type historyStorage struct {
+	Storage
+	mu        sync.RWMutex
+	size      int
+	retention time.Duration
+	now       func() time.Time
+	gauges    map[string]*series
+	counters  map[string]*series
+}
+
+func MakeStorageWithHistory(s Storage, size int, retention time.Duration) Storage {
+	return &historyStorage{
+		Storage:   s,
+		size:      size,
+		retention: retention,
+		now:       time.Now,
+		gauges:    make(map[string]*series),
+		counters:  make(map[string]*series),
+	}
+}
+
+func (h *historyStorage) record(target map[string]*series, values map[string]float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	for name, v := range values {
+		s, found := target[name]
+		if !found {
+			s = &series{}
+			target[name] = s
+		}
+		s.add(model.Point{Time: now, Value: v}, h.size)
+	}
+}
+
+func (h *historyStorage) history(source map[string]*series, name string, from, to time.Time) []model.Point {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	s, found := source[name]
+	if !found {
+		return nil
+	}
+	if cutoff := h.now().Add(-h.retention); h.retention > 0 && from.Before(cutoff) {
+		from = cutoff
+	}
+	return s.between(from, to)
+}
+
+func (h *historyStorage) SaveGauge(name string, v float64) error {
+	if err := h.Storage.SaveGauge(name, v); err != nil {
+		return err
+	}
+	h.record(h.gauges, map[string]float64{name: v})
+	return nil
+}
+
+func (h *historyStorage) SaveCounter(name string, v int64) error {
+	if err := h.Storage.SaveCounter(name, v); err != nil {
+		return err
+	}
+	h.record(h.counters, map[string]float64{name: float64(v)})
+	return nil
+}
+
+func (h *historyStorage) IncrementCounter(name string, delta int64) (int64, error) {
+	result, err := h.Storage.IncrementCounter(name, delta)
+	if err != nil {
+		return 0, err
+	}
+	h.record(h.counters, map[string]float64{name: float64(result)})
+	return result, nil
+}
+
+func (h *historyStorage) SaveBatch(deltas Batch) (Batch, error) {
+	result, err := h.Storage.SaveBatch(deltas)
+	if err != nil {
+		return Batch{}, err
+	}
+	counters := make(map[string]float64, len(result.Counters))
+	for k, v := range result.Counters {
+		counters[k] = float64(v)
+	}
+	h.record(h.counters, counters)
+	h.record(h.gauges, result.Gauges)
+	return result, nil
+}
+
+func (h *historyStorage) GaugeHistory(name string, from, to time.Time) ([]model.Point, error) {
+	return h.history(h.gauges, name, from, to), nil
+}
+
+func (h *historyStorage) CounterHistory(name string, from, to time.Time) ([]model.Point, error) {
+	return h.history(h.counters, name, from, to), nil
+}
@@ -0,0 +1,50 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryStorage(t *testing.T) {
+	now := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	hs := MakeStorageWithHistory(NewInMemoryStorage(), 3, time.Hour).(*historyStorage)
+	hs.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		hs.SaveGauge("g1", float64(i))
+		now = now.Add(time.Minute)
+	}
+	hs.IncrementCounter("c1", 2)
+	hs.SaveBatch(Batch{Counters: map[string]int64{"c1": 3}})
+
+	points, err := hs.GaugeHistory("g1", time.Time{}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{1, 2, 3}, valuesOf(points))
+
+	points, err = hs.GaugeHistory("g1", now.Add(-2*time.Minute), now)
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{2, 3}, valuesOf(points))
+
+	points, err = hs.CounterHistory("c1", time.Time{}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{2, 5}, valuesOf(points))
+
+	now = now.Add(2 * time.Hour)
+	points, err = hs.GaugeHistory("g1", time.Time{}, now)
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+
+	_, err = NewInMemoryStorage().GaugeHistory("g1", time.Time{}, now)
+	assert.ErrorIs(t, err, ErrHistoryDisabled)
+}
+
+func valuesOf(points []model.Point) []float64 {
+	var result []float64
+	for _, p := range points {
+		result = append(result, p.Value)
+	}
+	return result
+}
@@ -0,0 +1,385 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/javaman/go-metrics/internal/model"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS gauges (
+	name  TEXT PRIMARY KEY,
+	value DOUBLE PRECISION NOT NULL
+);
+CREATE TABLE IF NOT EXISTS counters (
+	name  TEXT PRIMARY KEY,
+	value BIGINT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS histograms (
+	name  TEXT PRIMARY KEY,
+	value JSONB NOT NULL
+);
+ALTER TABLE gauges ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE counters ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE histograms ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+`
+
+const (
+	upsertGauge      = "INSERT INTO gauges (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value, updated_at = now()"
+	upsertCounter    = "INSERT INTO counters (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value, updated_at = now()"
+	incrementCounter = "INSERT INTO counters (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = counters.value + EXCLUDED.value, updated_at = now() RETURNING value"
+	upsertHistogram  = "INSERT INTO histograms (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value, updated_at = now()"
+	lockHistogram    = "SELECT value FROM histograms WHERE name = $1 FOR UPDATE"
+)
+
+func IsRetriable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, "08") ||
+			pgErr.Code == "40001" ||
+			pgErr.Code == "40P01" ||
+			pgErr.Code == "57P03"
+	}
+	if pgconn.Timeout(err) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// IsNotApplied reports whether a failed write is known not to have been applied: it was never sent,
+// the connection could not be made, or the server rolled the transaction back.
+// Only such failures may be retried for writes that are not idempotent.
+func IsNotApplied(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "40P01" || pgErr.Code == "57P03"
+	}
+	var safe interface{ SafeToRetry() bool }
+	if errors.As(err, &safe) {
+		return safe.SafeToRetry()
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+type pgStorage struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresStorage(ctx context.Context, dsn string) (*pgStorage, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pool.Exec(ctx, schema); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &pgStorage{pool}, nil
+}
+
+func (p *pgStorage) Close() {
+	p.pool.Close()
+}
+
+func (p *pgStorage) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return p.pool.Ping(ctx)
+}
+
+func (p *pgStorage) WriteToFile(fname string) error {
+	return nil
+}
+
+func (p *pgStorage) GaugeHistory(name string, from, to time.Time) ([]model.Point, error) {
+	return nil, ErrHistoryDisabled
+}
+
+func (p *pgStorage) CounterHistory(name string, from, to time.Time) ([]model.Point, error) {
+	return nil, ErrHistoryDisabled
+}
+
+var tables = map[string]string{"gauge": "gauges", "counter": "counters", "histogram": "histograms"}
+
+func (p *pgStorage) Touch(mtype, name string, at time.Time) error {
+	table, ok := tables[mtype]
+	if !ok {
+		return nil
+	}
+	_, err := p.pool.Exec(context.Background(), "UPDATE "+table+" SET updated_at = $2 WHERE name = $1", name, at)
+	return err
+}
+
+func (p *pgStorage) UpdatedAt(mtype, name string) (time.Time, bool, error) {
+	table, ok := tables[mtype]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	var at time.Time
+	err := p.pool.QueryRow(context.Background(), "SELECT updated_at FROM "+table+" WHERE name = $1", name).Scan(&at)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return at, true, nil
+}
+
+func (p *pgStorage) SaveGauge(name string, v float64) error {
+	_, err := p.pool.Exec(context.Background(), upsertGauge, name, v)
+	return err
+}
+
+func (p *pgStorage) GetGauge(name string) (float64, bool, error) {
+	var v float64
+	err := p.pool.QueryRow(context.Background(), "SELECT value FROM gauges WHERE name = $1", name).Scan(&v)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+func (p *pgStorage) DeleteGauge(name string) error {
+	_, err := p.pool.Exec(context.Background(), "DELETE FROM gauges WHERE name = $1", name)
+	return err
+}
+
+func (p *pgStorage) DeleteGaugeIfNotUpdatedSince(name string, at time.Time) (bool, error) {
+	tag, err := p.pool.Exec(context.Background(), "DELETE FROM gauges WHERE name = $1 AND updated_at < $2", name, at)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (p *pgStorage) AllGauges(f func(string, float64)) error {
+	rows, err := p.pool.Query(context.Background(), "SELECT name, value FROM gauges")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var v float64
+		if err := rows.Scan(&name, &v); err != nil {
+			return err
+		}
+		f(name, v)
+	}
+	return rows.Err()
+}
+
+func (p *pgStorage) SaveCounter(name string, v int64) error {
+	_, err := p.pool.Exec(context.Background(), upsertCounter, name, v)
+	return err
+}
+
+func (p *pgStorage) IncrementCounter(name string, delta int64) (int64, error) {
+	var v int64
+	err := p.pool.QueryRow(context.Background(), incrementCounter, name, delta).Scan(&v)
+	return v, err
+}
+
+func (p *pgStorage) GetCounter(name string) (int64, bool, error) {
+	var v int64
+	err := p.pool.QueryRow(context.Background(), "SELECT value FROM counters WHERE name = $1", name).Scan(&v)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+func (p *pgStorage) AllCounters(f func(string, int64)) error {
+	rows, err := p.pool.Query(context.Background(), "SELECT name, value FROM counters")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var v int64
+		if err := rows.Scan(&name, &v); err != nil {
+			return err
+		}
+		f(name, v)
+	}
+	return rows.Err()
+}
+
+func (p *pgStorage) SaveHistogram(name string, h model.Histogram) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	_, err = p.pool.Exec(context.Background(), upsertHistogram, name, data)
+	return err
+}
+
+func mergeHistogram(ctx context.Context, tx pgx.Tx, name string, delta model.Histogram) (model.Histogram, error) {
+	// make sure the row exists so that concurrent merges of a new histogram wait on its lock
+	if _, err := tx.Exec(ctx, "INSERT INTO histograms (name, value) VALUES ($1, 'null') ON CONFLICT (name) DO NOTHING", name); err != nil {
+		return model.Histogram{}, err
+	}
+	var current *model.Histogram
+	if err := tx.QueryRow(ctx, lockHistogram, name).Scan(&current); err != nil {
+		return model.Histogram{}, err
+	}
+	result := delta.Clone()
+	if current != nil {
+		result = current.Merge(delta)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return model.Histogram{}, err
+	}
+	if _, err := tx.Exec(ctx, upsertHistogram, name, data); err != nil {
+		return model.Histogram{}, err
+	}
+	return result, nil
+}
+
+func (p *pgStorage) MergeHistogram(name string, delta model.Histogram) (model.Histogram, error) {
+	ctx := context.Background()
+	var result model.Histogram
+	err := pgx.BeginFunc(ctx, p.pool, func(tx pgx.Tx) error {
+		var err error
+		result, err = mergeHistogram(ctx, tx, name, delta)
+		return err
+	})
+	return result, err
+}
+
+func (p *pgStorage) GetHistogram(name string) (model.Histogram, bool, error) {
+	var h *model.Histogram
+	err := p.pool.QueryRow(context.Background(), "SELECT value FROM histograms WHERE name = $1", name).Scan(&h)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && h == nil) {
+		return model.Histogram{}, false, nil
+	}
+	if err != nil {
+		return model.Histogram{}, false, err
+	}
+	return *h, true, nil
+}
+
+func (p *pgStorage) AllHistograms(f func(string, model.Histogram)) error {
+	rows, err := p.pool.Query(context.Background(), "SELECT name, value FROM histograms WHERE value <> 'null'")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var h model.Histogram
+		if err := rows.Scan(&name, &h); err != nil {
+			return err
+		}
+		f(name, h)
+	}
+	return rows.Err()
+}
+
+// names are compared with the "C" collation to get the same byte order as the in-memory storage
+const scanMetrics = `
+SELECT name, type, gauge, counter, histogram FROM (
+	SELECT name, 'gauge' AS type, value AS gauge, NULL::BIGINT AS counter, NULL::JSONB AS histogram FROM gauges
+	UNION ALL SELECT name, 'counter', NULL, value, NULL FROM counters
+	UNION ALL SELECT name, 'histogram', NULL, NULL, value FROM histograms WHERE value <> 'null'
+) m
+WHERE $1 OR name COLLATE "C" %[1]s $2 OR (name = $2 AND type %[1]s $3)
+ORDER BY name COLLATE "C" %[2]s, type %[2]s`
+
+func (p *pgStorage) Scan(after ScanPosition, desc bool, f func(model.Metrics) bool) error {
+	query := fmt.Sprintf(scanMetrics, ">", "ASC")
+	if desc {
+		query = fmt.Sprintf(scanMetrics, "<", "DESC")
+	}
+	rows, err := p.pool.Query(context.Background(), query, after == ScanPosition{}, after.Key, after.MType)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m model.Metrics
+		if err := rows.Scan(&m.ID, &m.MType, &m.Value, &m.Delta, &m.Histogram); err != nil {
+			return err
+		}
+		if !f(m) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+func (p *pgStorage) SaveBatch(deltas Batch) (Batch, error) {
+	ctx := context.Background()
+	result := Batch{
+		Counters:   make(map[string]int64, len(deltas.Counters)),
+		Gauges:     deltas.Gauges,
+		Histograms: make(map[string]model.Histogram, len(deltas.Histograms)),
+		Updated:    deltas.Updated,
+	}
+	err := pgx.BeginFunc(ctx, p.pool, func(tx pgx.Tx) error {
+		names := make([]string, 0, len(deltas.Counters))
+		batch := &pgx.Batch{}
+		for k, v := range deltas.Counters {
+			names = append(names, k)
+			batch.Queue(incrementCounter, k, v)
+		}
+		for k, v := range deltas.Gauges {
+			batch.Queue(upsertGauge, k, v)
+		}
+		br := tx.SendBatch(ctx, batch)
+		for _, name := range names {
+			var v int64
+			if err := br.QueryRow().Scan(&v); err != nil {
+				br.Close()
+				return err
+			}
+			result.Counters[name] = v
+		}
+		if err := br.Close(); err != nil {
+			return err
+		}
+		for k, v := range deltas.Histograms {
+			h, err := mergeHistogram(ctx, tx, k, v)
+			if err != nil {
+				return err
+			}
+			result.Histograms[k] = h
+		}
+		touched := &pgx.Batch{}
+		for mtype, updated := range deltas.Updated {
+			for k, at := range updated {
+				if table, ok := tables[mtype]; ok {
+					touched.Queue("UPDATE "+table+" SET updated_at = $2 WHERE name = $1", k, at)
+				}
+			}
+		}
+		if touched.Len() == 0 {
+			return nil
+		}
+		return tx.SendBatch(ctx, touched).Close()
+	})
+	if err != nil {
+		return Batch{}, err
+	}
+	return result, nil
+}
@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPostgresStorage(t *testing.T) *pgStorage {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	ctx := context.Background()
+	ps, err := NewPostgresStorage(ctx, dsn)
+	require.NoError(t, err)
+	_, err = ps.pool.Exec(ctx, "TRUNCATE gauges, counters, histograms")
+	require.NoError(t, err)
+	t.Cleanup(ps.Close)
+	return ps
+}
+
+func TestPostgresStorageGauge(t *testing.T) {
+	ps := newTestPostgresStorage(t)
+
+	_, found, err := ps.GetGauge("g1")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	assert.NoError(t, ps.SaveGauge("g1", 3.14))
+	assert.NoError(t, ps.SaveGauge("g1", 2.72))
+
+	value, found, err := ps.GetGauge("g1")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 2.72, value)
+
+	at := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, ps.Touch("gauge", "g1", at))
+	updated, found, err := ps.UpdatedAt("gauge", "g1")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, at.Equal(updated))
+	_, found, err = ps.UpdatedAt("counter", "g1")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestPostgresStorageCounter(t *testing.T) {
+	ps := newTestPostgresStorage(t)
+
+	_, found, err := ps.GetCounter("c1")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	assert.NoError(t, ps.SaveCounter("c1", 40))
+	value, err := ps.IncrementCounter("c1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), value)
+
+	value, found, err = ps.GetCounter("c1")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, int64(42), value)
+}
+
+func TestPostgresStorageSaveBatch(t *testing.T) {
+	ps := newTestPostgresStorage(t)
+
+	assert.NoError(t, ps.SaveCounter("c1", 10))
+	totals, err := ps.SaveBatch(Batch{
+		Counters: map[string]int64{"c1": 1, "c2": 2},
+		Gauges:   map[string]float64{"pi": 3.14, "e": 2.72},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"c1": 11, "c2": 2}, totals.Counters)
+
+	counters := map[string]int64{}
+	assert.NoError(t, ps.AllCounters(func(k string, v int64) { counters[k] = v }))
+	assert.Equal(t, map[string]int64{"c1": 11, "c2": 2}, counters)
+
+	gauges := map[string]float64{}
+	assert.NoError(t, ps.AllGauges(func(k string, v float64) { gauges[k] = v }))
+	assert.Equal(t, map[string]float64{"pi": 3.14, "e": 2.72}, gauges)
+}
+
+func TestPostgresStorageBatchUpdateTimes(t *testing.T) {
+	testBatchUpdateTimes(t, newTestPostgresStorage(t))
+}
+
+func TestPostgresStorageHistogram(t *testing.T) {
+	ps := newTestPostgresStorage(t)
+
+	_, found, err := ps.GetHistogram("h1")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	delta := model.NewHistogram([]float64{0.1, 1})
+	delta.Observe(0.5)
+	_, err = ps.MergeHistogram("h1", delta)
+	assert.NoError(t, err)
+	totals, err := ps.SaveBatch(Batch{Histograms: map[string]model.Histogram{"h1": delta}})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0, 2, 0}, totals.Histograms["h1"].Counts)
+
+	h, found, err := ps.GetHistogram("h1")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, totals.Histograms["h1"], h)
+}
+
+func TestPostgresStorageScan(t *testing.T) {
+	testScan(t, newTestPostgresStorage(t))
+}
+
+func TestPostgresStorageDeleteGaugeIfNotUpdatedSince(t *testing.T) {
+	testDeleteGaugeIfNotUpdatedSince(t, newTestPostgresStorage(t))
+}
@@ -1,124 +1,825 @@
 package repository
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/javaman/go-metrics/internal/retry"
 )
 
+// Batch holds counter deltas and histogram deltas when passed to SaveBatch,
+// and the resulting totals when returned from it.
+type Batch struct {
+	Counters   map[string]int64
+	Gauges     map[string]float64
+	Histograms map[string]model.Histogram
+	// Updated holds update times by type and name, metrics missing from it are updated now
+	Updated map[string]map[string]time.Time
+}
+
+func (b Batch) names() map[string]bool {
+	names := make(map[string]bool, len(b.Counters)+len(b.Gauges)+len(b.Histograms))
+	for k := range b.Counters {
+		names[k] = true
+	}
+	for k := range b.Gauges {
+		names[k] = true
+	}
+	for k := range b.Histograms {
+		names[k] = true
+	}
+	return names
+}
+
+// ScanPosition identifies a metric by its storage key and type. The zero value is the start of a scan.
+type ScanPosition struct {
+	Key   string
+	MType string
+}
+
+func (p ScanPosition) less(other ScanPosition) bool {
+	if p.Key != other.Key {
+		return p.Key < other.Key
+	}
+	return p.MType < other.MType
+}
+
 type Storage interface {
-	SaveGauge(name string, v float64)
-	GetGauge(name string) (float64, bool)
-	AllGauges(func(string, float64))
-	SaveCounter(name string, v int64)
-	GetCounter(name string) (int64, bool)
-	AllCounters(func(string, int64))
-	WriteToFile(file string)
+	SaveGauge(name string, v float64) error
+	GetGauge(name string) (float64, bool, error)
+	AllGauges(func(string, float64)) error
+	DeleteGauge(name string) error
+	// DeleteGaugeIfNotUpdatedSince deletes the gauge only if it was last updated before at
+	// and reports whether it did.
+	DeleteGaugeIfNotUpdatedSince(name string, at time.Time) (bool, error)
+	SaveCounter(name string, v int64) error
+	IncrementCounter(name string, delta int64) (int64, error)
+	GetCounter(name string) (int64, bool, error)
+	AllCounters(func(string, int64)) error
+	SaveHistogram(name string, h model.Histogram) error
+	MergeHistogram(name string, delta model.Histogram) (model.Histogram, error)
+	GetHistogram(name string) (model.Histogram, bool, error)
+	AllHistograms(func(string, model.Histogram)) error
+	SaveBatch(deltas Batch) (Batch, error)
+	GaugeHistory(name string, from, to time.Time) ([]model.Point, error)
+	CounterHistory(name string, from, to time.Time) ([]model.Point, error)
+	Touch(mtype, name string, at time.Time) error
+	UpdatedAt(mtype, name string) (time.Time, bool, error)
+	// Scan calls f with metrics ordered by key and type, starting after the given position,
+	// until f returns false. The storage key is passed in ID.
+	Scan(after ScanPosition, desc bool, f func(model.Metrics) bool) error
+	WriteToFile(file string) error
+	Ping() error
 }
 
-func MakeStorageFlushedOnEachCall(s Storage, fname string) Storage {
-	return &wrappingSaveToFile{
+func MakeStorageFlushedOnEachCall(s Storage, fname string) (Storage, error) {
+	if err := s.WriteToFile(fname); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(walFileName(fname)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return &wrappingSaveToFile{wrappingCheckFile{
+		Storage:  s,
+		fileName: fname,
+	}}, nil
+}
+
+func MakeStorageRetrying(s Storage, delays []time.Duration) Storage {
+	return &wrappingRetry{
+		Storage: s,
+		delays:  delays,
+	}
+}
+
+func MakeStorageCheckingFile(s Storage, fname string) Storage {
+	return &wrappingCheckFile{
 		Storage:  s,
 		fileName: fname,
 	}
 }
 
-func NewInMemoryStorageFromFile(file string) Storage {
-	var result memStorage
-	if data, err := os.ReadFile(file); err == nil {
-		json.Unmarshal(data, &result)
+// checkWritable probes the directory rather than the file: WriteFileAtomic replaces the file
+// with a temporary one, so a writable file in a read-only directory can't be saved either.
+func checkWritable(fname string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fname), ".ping-*")
+	if err != nil {
+		return err
 	}
-	if result.counters == nil {
-		result.counters = make(map[string]int64)
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+func NewInMemoryStorageFromFile(file string) (Storage, error) {
+	result := NewInMemoryStorage()
+	data, err := os.ReadFile(file)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, result); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
 	}
-	if result.gauges == nil {
-		result.gauges = make(map[string]float64)
+	if err := replayWAL(result, walFileName(file)); err != nil {
+		return nil, err
 	}
-	return &result
+	return result, nil
 }
 
-func NewInMemoryStorage() *memStorage {
-	return &memStorage{make(map[string]int64), make(map[string]float64)}
+func WriteFileAtomic(fname string, data []byte) (err error) {
+	dir := filepath.Dir(fname)
+	tmp, err := os.CreateTemp(dir, filepath.Base(fname)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), fname); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+const shardsCount = 16
+
+// scanPageSize is how many positions Scan takes from the index at a time.
+const scanPageSize = 64
+
+// scanIndex keeps the positions of all stored metrics sorted for Scan. Shards add a metric when they
+// first store it and remove it on delete, both under the shard lock.
+type scanIndex struct {
+	sync.RWMutex
+	positions []ScanPosition
+}
+
+func (x *scanIndex) search(p ScanPosition) int {
+	return sort.Search(len(x.positions), func(i int) bool { return !x.positions[i].less(p) })
+}
+
+func (x *scanIndex) add(p ScanPosition) {
+	x.Lock()
+	defer x.Unlock()
+	i := x.search(p)
+	if i < len(x.positions) && x.positions[i] == p {
+		return
+	}
+	x.positions = append(x.positions, ScanPosition{})
+	copy(x.positions[i+1:], x.positions[i:])
+	x.positions[i] = p
+}
+
+func (x *scanIndex) remove(p ScanPosition) {
+	x.Lock()
+	defer x.Unlock()
+	if i := x.search(p); i < len(x.positions) && x.positions[i] == p {
+		x.positions = append(x.positions[:i], x.positions[i+1:]...)
+	}
+}
+
+// page returns up to n positions following after in the scan order.
+func (x *scanIndex) page(after ScanPosition, desc bool, n int) []ScanPosition {
+	x.RLock()
+	defer x.RUnlock()
+	var result []ScanPosition
+	if desc {
+		i := len(x.positions)
+		if after != (ScanPosition{}) {
+			i = x.search(after)
+		}
+		for ; i > 0 && len(result) < n; i-- {
+			result = append(result, x.positions[i-1])
+		}
+		return result
+	}
+	i := 0
+	if after != (ScanPosition{}) {
+		i = x.search(after)
+		if i < len(x.positions) && x.positions[i] == after {
+			i++
+		}
+	}
+	for ; i < len(x.positions) && len(result) < n; i++ {
+		result = append(result, x.positions[i])
+	}
+	return result
+}
+
+type memShard struct {
+	sync.RWMutex
+	counters   map[string]int64
+	gauges     map[string]float64
+	histograms map[string]model.Histogram
+	updated    map[string]map[string]time.Time
+	index      *scanIndex
 }
 
 type memStorage struct {
-	counters map[string]int64
-	gauges   map[string]float64
+	shards [shardsCount]*memShard
+	index  scanIndex
+	fileMu sync.Mutex
 }
 
-func (m *memStorage) WriteToFile(fname string) {
+func NewInMemoryStorage() *memStorage {
+	m := &memStorage{}
+	for i := range m.shards {
+		m.shards[i] = &memShard{
+			index:      &m.index,
+			counters:   make(map[string]int64),
+			gauges:     make(map[string]float64),
+			histograms: make(map[string]model.Histogram),
+			updated: map[string]map[string]time.Time{
+				"gauge":     make(map[string]time.Time),
+				"counter":   make(map[string]time.Time),
+				"histogram": make(map[string]time.Time),
+			},
+		}
+	}
+	return m
+}
+
+func shardIndex(name string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % shardsCount)
+}
+
+func (m *memStorage) shard(name string) *memShard {
+	return m.shards[shardIndex(name)]
+}
+
+func (m *memStorage) lockShards(names map[string]bool) func() {
+	used := make(map[int]bool)
+	for name := range names {
+		used[shardIndex(name)] = true
+	}
+	indexes := make([]int, 0, len(used))
+	for i := range used {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		m.shards[i].Lock()
+	}
+	return func() {
+		for _, i := range indexes {
+			m.shards[i].Unlock()
+		}
+	}
+}
+
+func (m *memStorage) WriteToFile(fname string) error {
+	m.fileMu.Lock()
+	defer m.fileMu.Unlock()
 	data, err := json.MarshalIndent(m, "", "   ")
-	if err == nil {
-		os.WriteFile(fname, data, 0666)
+	if err != nil {
+		return err
 	}
+	return WriteFileAtomic(fname, data)
+}
+
+func (m *memStorage) Ping() error {
+	return nil
 }
 
-func (m *memStorage) GetGauge(name string) (float64, bool) {
-	v, found := m.gauges[name]
-	return v, found
+func (m *memStorage) GaugeHistory(name string, from, to time.Time) ([]model.Point, error) {
+	return nil, ErrHistoryDisabled
 }
 
-func (m *memStorage) SaveGauge(name string, v float64) {
-	m.gauges[name] = v
+func (m *memStorage) CounterHistory(name string, from, to time.Time) ([]model.Point, error) {
+	return nil, ErrHistoryDisabled
 }
 
-func (m *memStorage) AllGauges(f func(string, float64)) {
-	for k, v := range m.gauges {
+func (s *memShard) has(mtype, name string) bool {
+	var found bool
+	switch mtype {
+	case "gauge":
+		_, found = s.gauges[name]
+	case "counter":
+		_, found = s.counters[name]
+	case "histogram":
+		_, found = s.histograms[name]
+	}
+	return found
+}
+
+// track adds a metric the shard doesn't hold yet to the scan index; call it before storing the metric.
+func (s *memShard) track(mtype, name string) {
+	if !s.has(mtype, name) {
+		s.index.add(ScanPosition{name, mtype})
+	}
+}
+
+func (s *memShard) deleteGauge(name string) {
+	if _, found := s.gauges[name]; found {
+		delete(s.gauges, name)
+		delete(s.updated["gauge"], name)
+		s.index.remove(ScanPosition{name, "gauge"})
+	}
+}
+
+// Touch sets the update time of a stored metric; every write sets it to now beforehand.
+func (m *memStorage) Touch(mtype, name string, at time.Time) error {
+	s := m.shard(name)
+	s.Lock()
+	defer s.Unlock()
+	if s.has(mtype, name) {
+		s.updated[mtype][name] = at
+	}
+	return nil
+}
+
+func (m *memStorage) UpdatedAt(mtype, name string) (time.Time, bool, error) {
+	s := m.shard(name)
+	s.RLock()
+	defer s.RUnlock()
+	at, found := s.updated[mtype][name]
+	return at, found, nil
+}
+
+func (m *memStorage) updatedSnapshot() map[string]map[string]time.Time {
+	result := make(map[string]map[string]time.Time)
+	for _, s := range m.shards {
+		s.RLock()
+		for mtype, updated := range s.updated {
+			for k, v := range updated {
+				if result[mtype] == nil {
+					result[mtype] = make(map[string]time.Time)
+				}
+				result[mtype][k] = v
+			}
+		}
+		s.RUnlock()
+	}
+	return result
+}
+
+func (m *memStorage) GetGauge(name string) (float64, bool, error) {
+	s := m.shard(name)
+	s.RLock()
+	defer s.RUnlock()
+	v, found := s.gauges[name]
+	return v, found, nil
+}
+
+func (m *memStorage) SaveGauge(name string, v float64) error {
+	s := m.shard(name)
+	s.Lock()
+	defer s.Unlock()
+	s.track("gauge", name)
+	s.gauges[name] = v
+	s.updated["gauge"][name] = time.Now()
+	return nil
+}
+
+func (m *memStorage) DeleteGauge(name string) error {
+	s := m.shard(name)
+	s.Lock()
+	defer s.Unlock()
+	s.deleteGauge(name)
+	return nil
+}
+
+func (m *memStorage) DeleteGaugeIfNotUpdatedSince(name string, at time.Time) (bool, error) {
+	s := m.shard(name)
+	s.Lock()
+	defer s.Unlock()
+	updated, found := s.updated["gauge"][name]
+	if !found || !updated.Before(at) {
+		return false, nil
+	}
+	s.deleteGauge(name)
+	return true, nil
+}
+
+func (m *memStorage) gaugesSnapshot() map[string]float64 {
+	result := make(map[string]float64)
+	for _, s := range m.shards {
+		s.RLock()
+		for k, v := range s.gauges {
+			result[k] = v
+		}
+		s.RUnlock()
+	}
+	return result
+}
+
+func (m *memStorage) AllGauges(f func(string, float64)) error {
+	for k, v := range m.gaugesSnapshot() {
 		f(k, v)
 	}
+	return nil
 }
 
-func (m *memStorage) GetCounter(name string) (int64, bool) {
-	v, found := m.counters[name]
-	return v, found
+func (m *memStorage) GetCounter(name string) (int64, bool, error) {
+	s := m.shard(name)
+	s.RLock()
+	defer s.RUnlock()
+	v, found := s.counters[name]
+	return v, found, nil
 }
 
-func (m *memStorage) SaveCounter(name string, v int64) {
-	m.counters[name] = v
+func (m *memStorage) SaveCounter(name string, v int64) error {
+	s := m.shard(name)
+	s.Lock()
+	defer s.Unlock()
+	s.track("counter", name)
+	s.counters[name] = v
+	s.updated["counter"][name] = time.Now()
+	return nil
+}
+
+func (m *memStorage) IncrementCounter(name string, delta int64) (int64, error) {
+	s := m.shard(name)
+	s.Lock()
+	defer s.Unlock()
+	s.track("counter", name)
+	s.counters[name] += delta
+	s.updated["counter"][name] = time.Now()
+	return s.counters[name], nil
+}
+
+func (m *memStorage) countersSnapshot() map[string]int64 {
+	result := make(map[string]int64)
+	for _, s := range m.shards {
+		s.RLock()
+		for k, v := range s.counters {
+			result[k] = v
+		}
+		s.RUnlock()
+	}
+	return result
 }
 
-func (m *memStorage) AllCounters(f func(string, int64)) {
-	for k, v := range m.counters {
+func (m *memStorage) AllCounters(f func(string, int64)) error {
+	for k, v := range m.countersSnapshot() {
 		f(k, v)
 	}
+	return nil
+}
+
+func (m *memStorage) SaveHistogram(name string, h model.Histogram) error {
+	s := m.shard(name)
+	s.Lock()
+	defer s.Unlock()
+	s.track("histogram", name)
+	s.histograms[name] = h.Clone()
+	s.updated["histogram"][name] = time.Now()
+	return nil
+}
+
+func (s *memShard) mergeHistogram(name string, delta model.Histogram) model.Histogram {
+	s.track("histogram", name)
+	result := delta.Clone()
+	if h, found := s.histograms[name]; found {
+		result = h.Merge(delta)
+	}
+	s.histograms[name] = result
+	s.updated["histogram"][name] = time.Now()
+	return result
+}
+
+func (m *memStorage) MergeHistogram(name string, delta model.Histogram) (model.Histogram, error) {
+	s := m.shard(name)
+	s.Lock()
+	defer s.Unlock()
+	return s.mergeHistogram(name, delta).Clone(), nil
+}
+
+func (m *memStorage) GetHistogram(name string) (model.Histogram, bool, error) {
+	s := m.shard(name)
+	s.RLock()
+	defer s.RUnlock()
+	h, found := s.histograms[name]
+	return h.Clone(), found, nil
+}
+
+func (m *memStorage) histogramsSnapshot() map[string]model.Histogram {
+	result := make(map[string]model.Histogram)
+	for _, s := range m.shards {
+		s.RLock()
+		for k, v := range s.histograms {
+			result[k] = v.Clone()
+		}
+		s.RUnlock()
+	}
+	return result
+}
+
+func (m *memStorage) AllHistograms(f func(string, model.Histogram)) error {
+	for k, v := range m.histogramsSnapshot() {
+		f(k, v)
+	}
+	return nil
+}
+
+func (m *memStorage) metric(p ScanPosition) (model.Metrics, bool) {
+	s := m.shard(p.Key)
+	s.RLock()
+	defer s.RUnlock()
+	result := model.Metrics{ID: p.Key, MType: p.MType}
+	switch p.MType {
+	case "gauge":
+		v, found := s.gauges[p.Key]
+		result.Value = &v
+		return result, found
+	case "counter":
+		v, found := s.counters[p.Key]
+		result.Delta = &v
+		return result, found
+	case "histogram":
+		h, found := s.histograms[p.Key]
+		h = h.Clone()
+		result.Histogram = &h
+		return result, found
+	}
+	return result, false
+}
+
+// Scan walks the sorted index a page at a time, so neither the index nor a shard is locked while f runs.
+// A metric deleted after its page was taken is skipped.
+func (m *memStorage) Scan(after ScanPosition, desc bool, f func(model.Metrics) bool) error {
+	for {
+		page := m.index.page(after, desc, scanPageSize)
+		for _, p := range page {
+			if metric, found := m.metric(p); found && !f(metric) {
+				return nil
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		after = page[len(page)-1]
+	}
+}
+
+func (m *memStorage) SaveBatch(deltas Batch) (Batch, error) {
+	names := deltas.names()
+	unlock := m.lockShards(names)
+	defer unlock()
+
+	result := Batch{
+		Counters:   make(map[string]int64, len(deltas.Counters)),
+		Gauges:     deltas.Gauges,
+		Histograms: make(map[string]model.Histogram, len(deltas.Histograms)),
+		Updated:    deltas.Updated,
+	}
+	now := time.Now()
+	for k, v := range deltas.Counters {
+		s := m.shard(k)
+		s.track("counter", k)
+		s.counters[k] += v
+		s.updated["counter"][k] = now
+		result.Counters[k] = s.counters[k]
+	}
+	for k, v := range deltas.Gauges {
+		s := m.shard(k)
+		s.track("gauge", k)
+		s.gauges[k] = v
+		s.updated["gauge"][k] = now
+	}
+	for k, v := range deltas.Histograms {
+		result.Histograms[k] = m.shard(k).mergeHistogram(k, v).Clone()
+	}
+	for mtype, updated := range deltas.Updated {
+		for k, at := range updated {
+			if s := m.shard(k); names[k] && s.has(mtype, k) {
+				s.updated[mtype][k] = at
+			}
+		}
+	}
+	return result, nil
 }
 
 type wrappingSaveToFile struct {
+	wrappingCheckFile
+}
+
+func (m *wrappingSaveToFile) SaveCounter(name string, v int64) error {
+	if err := m.Storage.SaveCounter(name, v); err != nil {
+		return err
+	}
+	return m.Storage.WriteToFile(m.fileName)
+}
+
+func (m *wrappingSaveToFile) IncrementCounter(name string, delta int64) (int64, error) {
+	result, err := m.Storage.IncrementCounter(name, delta)
+	if err != nil {
+		return 0, err
+	}
+	return result, m.Storage.WriteToFile(m.fileName)
+}
+
+func (m *wrappingSaveToFile) SaveGauge(name string, v float64) error {
+	if err := m.Storage.SaveGauge(name, v); err != nil {
+		return err
+	}
+	return m.Storage.WriteToFile(m.fileName)
+}
+
+func (m *wrappingSaveToFile) SaveHistogram(name string, h model.Histogram) error {
+	if err := m.Storage.SaveHistogram(name, h); err != nil {
+		return err
+	}
+	return m.Storage.WriteToFile(m.fileName)
+}
+
+func (m *wrappingSaveToFile) MergeHistogram(name string, delta model.Histogram) (model.Histogram, error) {
+	result, err := m.Storage.MergeHistogram(name, delta)
+	if err != nil {
+		return model.Histogram{}, err
+	}
+	return result, m.Storage.WriteToFile(m.fileName)
+}
+
+func (m *wrappingSaveToFile) DeleteGauge(name string) error {
+	if err := m.Storage.DeleteGauge(name); err != nil {
+		return err
+	}
+	return m.Storage.WriteToFile(m.fileName)
+}
+
+func (m *wrappingSaveToFile) DeleteGaugeIfNotUpdatedSince(name string, at time.Time) (bool, error) {
+	deleted, err := m.Storage.DeleteGaugeIfNotUpdatedSince(name, at)
+	if err != nil || !deleted {
+		return deleted, err
+	}
+	return true, m.Storage.WriteToFile(m.fileName)
+}
+
+func (m *wrappingSaveToFile) SaveBatch(deltas Batch) (Batch, error) {
+	result, err := m.Storage.SaveBatch(deltas)
+	if err != nil {
+		return Batch{}, err
+	}
+	return result, m.Storage.WriteToFile(m.fileName)
+}
+
+func (m *wrappingSaveToFile) Touch(mtype, name string, at time.Time) error {
+	if err := m.Storage.Touch(mtype, name, at); err != nil {
+		return err
+	}
+	return m.Storage.WriteToFile(m.fileName)
+}
+
+type wrappingCheckFile struct {
 	Storage
 	fileName string
 }
 
-func (m *wrappingSaveToFile) SaveCounter(name string, v int64) {
-	m.Storage.SaveCounter(name, v)
-	m.Storage.WriteToFile(m.fileName)
+func (m *wrappingCheckFile) Ping() error {
+	if err := m.Storage.Ping(); err != nil {
+		return err
+	}
+	return checkWritable(m.fileName)
+}
+
+type wrappingRetry struct {
+	Storage
+	delays []time.Duration
+}
+
+func (m *wrappingRetry) do(f func() error) error {
+	return retry.Do(context.Background(), m.delays, IsRetriable, f)
+}
+
+// doOnce retries writes that would be applied twice if repeated, only when the failed attempt was not applied.
+func (m *wrappingRetry) doOnce(f func() error) error {
+	return retry.Do(context.Background(), m.delays, IsNotApplied, f)
 }
 
-func (m *wrappingSaveToFile) SaveGauge(name string, v float64) {
-	m.Storage.SaveGauge(name, v)
-	m.Storage.WriteToFile(m.fileName)
+func (m *wrappingRetry) SaveCounter(name string, v int64) error {
+	return m.do(func() error { return m.Storage.SaveCounter(name, v) })
+}
+
+func (m *wrappingRetry) IncrementCounter(name string, delta int64) (int64, error) {
+	var result int64
+	err := m.doOnce(func() error {
+		var err error
+		result, err = m.Storage.IncrementCounter(name, delta)
+		return err
+	})
+	return result, err
+}
+
+func (m *wrappingRetry) SaveGauge(name string, v float64) error {
+	return m.do(func() error { return m.Storage.SaveGauge(name, v) })
+}
+
+func (m *wrappingRetry) DeleteGauge(name string) error {
+	return m.do(func() error { return m.Storage.DeleteGauge(name) })
+}
+
+func (m *wrappingRetry) Touch(mtype, name string, at time.Time) error {
+	return m.do(func() error { return m.Storage.Touch(mtype, name, at) })
+}
+
+func (m *wrappingRetry) DeleteGaugeIfNotUpdatedSince(name string, at time.Time) (bool, error) {
+	var deleted bool
+	err := m.do(func() error {
+		var err error
+		deleted, err = m.Storage.DeleteGaugeIfNotUpdatedSince(name, at)
+		return err
+	})
+	return deleted, err
+}
+
+func (m *wrappingRetry) SaveHistogram(name string, h model.Histogram) error {
+	return m.do(func() error { return m.Storage.SaveHistogram(name, h) })
+}
+
+func (m *wrappingRetry) MergeHistogram(name string, delta model.Histogram) (model.Histogram, error) {
+	var result model.Histogram
+	err := m.doOnce(func() error {
+		var err error
+		result, err = m.Storage.MergeHistogram(name, delta)
+		return err
+	})
+	return result, err
+}
+
+func (m *wrappingRetry) SaveBatch(deltas Batch) (Batch, error) {
+	var result Batch
+	err := m.doOnce(func() error {
+		var err error
+		result, err = m.Storage.SaveBatch(deltas)
+		return err
+	})
+	return result, err
 }
 
 func (m *memStorage) UnmarshalJSON(b []byte) error {
-	fmt.Println("Here")
 	var tmp struct {
-		Counters map[string]int64   `json:"counters"`
-		Gauges   map[string]float64 `json:"gauges"`
+		Counters   map[string]int64                `json:"counters"`
+		Gauges     map[string]float64              `json:"gauges"`
+		Histograms map[string]model.Histogram      `json:"histograms"`
+		Updated    map[string]map[string]time.Time `json:"updated"`
 	}
 	err := json.Unmarshal(b, &tmp)
 	if err != nil {
 		return err
 	}
-	m.counters = tmp.Counters
-	m.gauges = tmp.Gauges
+	for k, v := range tmp.Counters {
+		m.SaveCounter(k, v)
+	}
+	for k, v := range tmp.Gauges {
+		m.SaveGauge(k, v)
+	}
+	for k, v := range tmp.Histograms {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("histogram %s: %w", k, err)
+		}
+		m.SaveHistogram(k, v)
+	}
+	for mtype, updated := range tmp.Updated {
+		for k, at := range updated {
+			m.Touch(mtype, k, at)
+		}
+	}
 	return nil
 }
 
 func (m *memStorage) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		Counters map[string]int64   `json:"counters"`
-		Gauges   map[string]float64 `json:"gauges"`
+		Counters   map[string]int64                `json:"counters"`
+		Gauges     map[string]float64              `json:"gauges"`
+		Histograms map[string]model.Histogram      `json:"histograms,omitempty"`
+		Updated    map[string]map[string]time.Time `json:"updated,omitempty"`
 	}{
-		Counters: m.counters,
-		Gauges:   m.gauges,
+		Counters:   m.countersSnapshot(),
+		Gauges:     m.gaugesSnapshot(),
+		Histograms: m.histogramsSnapshot(),
+		Updated:    m.updatedSnapshot(),
 	})
 }
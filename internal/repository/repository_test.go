@@ -1,9 +1,17 @@
 package repository
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/javaman/go-metrics/internal/model"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMemStorageAddGauge(t *testing.T) {
@@ -14,7 +22,7 @@ func TestMemStorageAddGauge(t *testing.T) {
 
 	ms.SaveGauge(gaugeName, gaugeValue)
 
-	assert.Equal(t, gaugeValue, ms.gauges[gaugeName], "Test add gauge Gauge with same name must be equal")
+	assert.Equal(t, gaugeValue, ms.shard(gaugeName).gauges[gaugeName], "Test add gauge Gauge with same name must be equal")
 }
 
 func TestMemStorageGetGauge(t *testing.T) {
@@ -23,9 +31,9 @@ func TestMemStorageGetGauge(t *testing.T) {
 	const gaugeName = "g1"
 	const gaugeValue = float64(3.14)
 
-	ms.gauges[gaugeName] = gaugeValue
+	ms.shard(gaugeName).gauges[gaugeName] = gaugeValue
 
-	if value, ok := ms.GetGauge(gaugeName); ok {
+	if value, ok, _ := ms.GetGauge(gaugeName); ok {
 		assert.Equal(t, gaugeValue, value, "Test get gauge with same name must be equal")
 	} else {
 		assert.Fail(t, "Gague Value Must Be There")
@@ -38,7 +46,7 @@ func TestMemStorageGetGaugeNotExist(t *testing.T) {
 
 	const gaugeName = "g1"
 
-	if _, ok := ms.GetGauge(gaugeName); ok {
+	if _, ok, _ := ms.GetGauge(gaugeName); ok {
 		assert.Fail(t, "Unexpected gauge")
 	}
 
@@ -72,7 +80,7 @@ func TestMemStorageAddCounter(t *testing.T) {
 
 	ms.SaveCounter(counterName, counterValue)
 
-	assert.Equal(t, counterValue, ms.counters[counterName], "Test add counter with same name must be equal")
+	assert.Equal(t, counterValue, ms.shard(counterName).counters[counterName], "Test add counter with same name must be equal")
 }
 
 func TestMemStorageGetCounter(t *testing.T) {
@@ -81,9 +89,9 @@ func TestMemStorageGetCounter(t *testing.T) {
 	const counterName = "g1"
 	const counterValue = int64(42)
 
-	ms.counters[counterName] = counterValue
+	ms.shard(counterName).counters[counterName] = counterValue
 
-	if value, ok := ms.GetCounter(counterName); ok {
+	if value, ok, _ := ms.GetCounter(counterName); ok {
 		assert.Equal(t, counterValue, value, "Test GetCounter with same name must be equal")
 	} else {
 		assert.Fail(t, "Counter Value Must Be There")
@@ -96,7 +104,7 @@ func TestMemStorageGetCounterNotExist(t *testing.T) {
 
 	const counterName = "c1"
 
-	if _, ok := ms.GetCounter(counterName); ok {
+	if _, ok, _ := ms.GetCounter(counterName); ok {
 		assert.Fail(t, "Unexpected counter")
 	}
 
@@ -121,3 +129,274 @@ func TestMemStorageAllCounters(t *testing.T) {
 	})
 	assert.Empty(t, testData, "all counters must be enumerated")
 }
+
+func TestMemStorageSaveBatch(t *testing.T) {
+	ms := NewInMemoryStorage()
+
+	ms.SaveCounter("c1", 1)
+	totals, err := ms.SaveBatch(Batch{
+		Counters: map[string]int64{"c1": 41, "c2": 2},
+		Gauges:   map[string]float64{"g1": 3.14},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"c1": 42, "c2": 2}, totals.Counters)
+	assert.Equal(t, int64(42), ms.shard("c1").counters["c1"])
+	assert.Equal(t, 3.14, ms.shard("g1").gauges["g1"])
+}
+
+func TestMemStoragePing(t *testing.T) {
+	dir := t.TempDir()
+
+	fs, err := MakeStorageFlushedOnEachCall(NewInMemoryStorage(), filepath.Join(dir, "db.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, fs.Ping())
+	assert.NoError(t, MakeStorageCheckingFile(NewInMemoryStorage(), filepath.Join(dir, "db.json")).Ping())
+	assert.Error(t, MakeStorageCheckingFile(NewInMemoryStorage(), filepath.Join(dir, "missing", "db.json")).Ping())
+}
+
+type flakyStorage struct {
+	*memStorage
+	failures int
+}
+
+func (f *flakyStorage) SaveGauge(name string, v float64) error {
+	if f.failures > 0 {
+		f.failures--
+		return syscall.ECONNREFUSED
+	}
+	return f.memStorage.SaveGauge(name, v)
+}
+
+func (f *flakyStorage) IncrementCounter(name string, delta int64) (int64, error) {
+	if f.failures > 0 {
+		f.failures--
+		if _, err := f.memStorage.IncrementCounter(name, delta); err != nil {
+			return 0, err
+		}
+		return 0, syscall.ECONNRESET
+	}
+	return f.memStorage.IncrementCounter(name, delta)
+}
+
+func TestStorageRetrying(t *testing.T) {
+	fs := &flakyStorage{NewInMemoryStorage(), 2}
+	rs := MakeStorageRetrying(fs, []time.Duration{time.Millisecond, time.Millisecond})
+
+	assert.NoError(t, rs.SaveGauge("g1", 3.14))
+	assert.Equal(t, 3.14, fs.shard("g1").gauges["g1"])
+
+	fs.failures = 3
+	assert.ErrorIs(t, rs.SaveGauge("g1", 2.72), syscall.ECONNREFUSED)
+
+	// the connection broke after the increment was applied, so it must not be repeated
+	fs.failures = 1
+	_, err := rs.IncrementCounter("c1", 5)
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+	assert.Equal(t, int64(5), fs.shard("c1").counters["c1"])
+}
+
+func TestMemStorageIncrementCounter(t *testing.T) {
+	ms := NewInMemoryStorage()
+
+	v, err := ms.IncrementCounter("c1", 40)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(40), v)
+
+	v, err = ms.IncrementCounter("c1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), v)
+}
+
+func TestMemStorageConcurrent(t *testing.T) {
+	ms := NewInMemoryStorage()
+	fname := filepath.Join(t.TempDir(), "db.json")
+
+	const goroutines = 32
+	const iterations = 500
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				ms.IncrementCounter("shared", 1)
+				ms.SaveBatch(Batch{
+					Counters: map[string]int64{"batched": 1},
+					Gauges:   map[string]float64{fmt.Sprintf("g%d", i%10): float64(g)},
+				})
+				ms.SaveGauge(fmt.Sprintf("own%d", g), float64(i))
+				ms.GetGauge("g1")
+				ms.GetCounter("shared")
+				if i%100 == 0 {
+					ms.AllGauges(func(string, float64) {})
+					ms.AllCounters(func(string, int64) {})
+					ms.WriteToFile(fname)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	shared, _, _ := ms.GetCounter("shared")
+	assert.Equal(t, int64(goroutines*iterations), shared)
+	batched, _, _ := ms.GetCounter("batched")
+	assert.Equal(t, int64(goroutines*iterations), batched)
+
+	restored, err := NewInMemoryStorageFromFile(fname)
+	assert.NoError(t, err)
+	_, found, _ := restored.GetCounter("shared")
+	assert.True(t, found)
+}
+
+func TestMemStorageWriteToFile(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "db.json")
+
+	ms := NewInMemoryStorage()
+	ms.SaveGauge("g1", 3.14)
+	ms.SaveCounter("c1", 42)
+	assert.NoError(t, ms.WriteToFile(fname))
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries), "temporary files must be renamed")
+
+	restored, err := NewInMemoryStorageFromFile(fname)
+	assert.NoError(t, err)
+	v, _, _ := restored.GetGauge("g1")
+	assert.Equal(t, 3.14, v)
+	c, _, _ := restored.GetCounter("c1")
+	assert.Equal(t, int64(42), c)
+
+	assert.Error(t, ms.WriteToFile(filepath.Join(dir, "missing", "db.json")))
+}
+
+func TestNewInMemoryStorageFromFileErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	ms, err := NewInMemoryStorageFromFile(filepath.Join(dir, "absent.json"))
+	assert.NoError(t, err)
+	assert.NotNil(t, ms)
+
+	corrupted := filepath.Join(dir, "corrupted.json")
+	assert.NoError(t, os.WriteFile(corrupted, []byte(`{"gauges": {"g1": `), 0644))
+	_, err = NewInMemoryStorageFromFile(corrupted)
+	assert.Error(t, err)
+}
+
+func TestMemStorageHistogram(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "db.json")
+	ms := NewInMemoryStorage()
+
+	delta := model.NewHistogram([]float64{0.1, 1})
+	delta.Observe(0.5)
+	h, err := ms.MergeHistogram("h1", delta)
+	assert.NoError(t, err)
+	assert.Equal(t, delta, h)
+
+	totals, err := ms.SaveBatch(Batch{Histograms: map[string]model.Histogram{"h1": delta}})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0, 2, 0}, totals.Histograms["h1"].Counts)
+	assert.Equal(t, uint64(1), delta.Count, "delta must not be modified")
+
+	assert.NoError(t, ms.WriteToFile(fname))
+	restored, err := NewInMemoryStorageFromFile(fname)
+	assert.NoError(t, err)
+	h, found, err := restored.GetHistogram("h1")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, totals.Histograms["h1"], h)
+}
+
+func scanPositions(t *testing.T, s Storage, after ScanPosition, desc bool, limit int) []ScanPosition {
+	var result []ScanPosition
+	err := s.Scan(after, desc, func(m model.Metrics) bool {
+		result = append(result, ScanPosition{m.ID, m.MType})
+		return len(result) < limit
+	})
+	require.NoError(t, err)
+	return result
+}
+
+func testScan(t *testing.T, s Storage) {
+	require.NoError(t, s.SaveGauge("b", 1))
+	require.NoError(t, s.SaveCounter("b", 2))
+	require.NoError(t, s.SaveGauge(`a{host="h"}`, 3))
+	require.NoError(t, s.SaveGauge("a", 4))
+	require.NoError(t, s.SaveHistogram("c", model.NewHistogram([]float64{1})))
+
+	all := []ScanPosition{{"a", "gauge"}, {`a{host="h"}`, "gauge"}, {"b", "counter"}, {"b", "gauge"}, {"c", "histogram"}}
+	assert.Equal(t, all, scanPositions(t, s, ScanPosition{}, false, 10))
+	assert.Equal(t, all[2:4], scanPositions(t, s, all[1], false, 2))
+	assert.Equal(t, []ScanPosition{all[4], all[3], all[2]}, scanPositions(t, s, ScanPosition{}, true, 3))
+	assert.Equal(t, []ScanPosition{all[1], all[0]}, scanPositions(t, s, all[2], true, 10))
+	assert.Empty(t, scanPositions(t, s, all[4], false, 10))
+
+	var values []model.Metrics
+	require.NoError(t, s.Scan(ScanPosition{Key: "b"}, false, func(m model.Metrics) bool {
+		values = append(values, m)
+		return true
+	}))
+	require.Equal(t, 3, len(values))
+	assert.Equal(t, int64(2), *values[0].Delta)
+	assert.Equal(t, 1.0, *values[1].Value)
+	assert.Equal(t, []float64{1}, values[2].Histogram.Bounds)
+}
+
+func TestMemStorageScan(t *testing.T) {
+	testScan(t, NewInMemoryStorage())
+}
+
+func TestMemStorageScanPages(t *testing.T) {
+	s := NewInMemoryStorage()
+	var all []ScanPosition
+	for i := 0; i < 3*scanPageSize; i++ {
+		name := fmt.Sprintf("g%03d", i)
+		require.NoError(t, s.SaveGauge(name, float64(i)))
+		all = append(all, ScanPosition{name, "gauge"})
+	}
+	require.NoError(t, s.SaveGauge("g000", 1))
+	assert.Equal(t, all, scanPositions(t, s, ScanPosition{}, false, len(all)+1))
+	assert.Equal(t, all[:scanPageSize+1], scanPositions(t, s, ScanPosition{}, false, scanPageSize+1))
+	assert.Equal(t, []ScanPosition{all[1], all[0]}, scanPositions(t, s, all[2], true, 10))
+
+	// writes from the callback don't block, deleted metrics ahead are skipped
+	var seen int
+	require.NoError(t, s.Scan(ScanPosition{}, false, func(m model.Metrics) bool {
+		if seen == 0 {
+			require.NoError(t, s.DeleteGauge(all[1].Key))
+			require.NoError(t, s.DeleteGauge(all[2*scanPageSize].Key))
+			require.NoError(t, s.SaveCounter("h", 1))
+		}
+		seen++
+		return true
+	}))
+	assert.Equal(t, len(all)-2+1, seen)
+}
+
+func testDeleteGaugeIfNotUpdatedSince(t *testing.T, s Storage) {
+	require.NoError(t, s.SaveGauge("g1", 1))
+	at := time.Now().Add(-time.Minute)
+	require.NoError(t, s.Touch("gauge", "g1", at))
+
+	deleted, err := s.DeleteGaugeIfNotUpdatedSince("g1", at)
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	require.NoError(t, s.SaveGauge("g1", 2))
+	deleted, err = s.DeleteGaugeIfNotUpdatedSince("g1", at.Add(time.Second))
+	assert.NoError(t, err)
+	assert.False(t, deleted, "updated by the save")
+
+	require.NoError(t, s.Touch("gauge", "g1", at))
+	deleted, err = s.DeleteGaugeIfNotUpdatedSince("g1", at.Add(time.Second))
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	_, found, _ := s.GetGauge("g1")
+	assert.False(t, found)
+}
+
+func TestDeleteGaugeIfNotUpdatedSince(t *testing.T) {
+	testDeleteGaugeIfNotUpdatedSince(t, NewInMemoryStorage())
+}
@@ -0,0 +1,167 @@
+package repository
+
+import (
+	"sync"
+	"time"
+
+	"github.com/javaman/go-metrics/internal/model"
+)
+
+type timestampStorage struct {
+	Storage
+	mu      sync.RWMutex
+	updated map[string]map[string]time.Time
+}
+
+// MakeStorageWithTimestamps caches last-updated times in memory and writes them through to s.
+// Stored metrics keep the time persisted with them; those without one count as updated at startup.
+func MakeStorageWithTimestamps(s Storage) (Storage, error) {
+	now := time.Now()
+	t := &timestampStorage{
+		Storage: s,
+		updated: map[string]map[string]time.Time{
+			"gauge":     make(map[string]time.Time),
+			"counter":   make(map[string]time.Time),
+			"histogram": make(map[string]time.Time),
+		},
+	}
+	var names []ScanPosition
+	err := s.AllGauges(func(name string, _ float64) { names = append(names, ScanPosition{name, "gauge"}) })
+	if err != nil {
+		return nil, err
+	}
+	err = s.AllCounters(func(name string, _ int64) { names = append(names, ScanPosition{name, "counter"}) })
+	if err != nil {
+		return nil, err
+	}
+	err = s.AllHistograms(func(name string, _ model.Histogram) { names = append(names, ScanPosition{name, "histogram"}) })
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		at, found, err := s.UpdatedAt(n.MType, n.Key)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			at = now
+		}
+		t.updated[n.MType][n.Key] = at
+	}
+	return t, nil
+}
+
+func (t *timestampStorage) stamp(mtype, name string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.updated[mtype][name] = at
+}
+
+func (t *timestampStorage) SaveGauge(name string, v float64) error {
+	if err := t.Storage.SaveGauge(name, v); err != nil {
+		return err
+	}
+	t.stamp("gauge", name, time.Now())
+	return nil
+}
+
+func (t *timestampStorage) SaveCounter(name string, v int64) error {
+	if err := t.Storage.SaveCounter(name, v); err != nil {
+		return err
+	}
+	t.stamp("counter", name, time.Now())
+	return nil
+}
+
+func (t *timestampStorage) IncrementCounter(name string, delta int64) (int64, error) {
+	result, err := t.Storage.IncrementCounter(name, delta)
+	if err != nil {
+		return 0, err
+	}
+	t.stamp("counter", name, time.Now())
+	return result, nil
+}
+
+func (t *timestampStorage) SaveHistogram(name string, h model.Histogram) error {
+	if err := t.Storage.SaveHistogram(name, h); err != nil {
+		return err
+	}
+	t.stamp("histogram", name, time.Now())
+	return nil
+}
+
+func (t *timestampStorage) MergeHistogram(name string, delta model.Histogram) (model.Histogram, error) {
+	result, err := t.Storage.MergeHistogram(name, delta)
+	if err != nil {
+		return model.Histogram{}, err
+	}
+	t.stamp("histogram", name, time.Now())
+	return result, nil
+}
+
+func (t *timestampStorage) SaveBatch(deltas Batch) (Batch, error) {
+	result, err := t.Storage.SaveBatch(deltas)
+	if err != nil {
+		return Batch{}, err
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stamp := func(mtype, name string) {
+		at, found := deltas.Updated[mtype][name]
+		if !found {
+			at = now
+		}
+		t.updated[mtype][name] = at
+	}
+	for k := range deltas.Counters {
+		stamp("counter", k)
+	}
+	for k := range deltas.Gauges {
+		stamp("gauge", k)
+	}
+	for k := range deltas.Histograms {
+		stamp("histogram", k)
+	}
+	return result, nil
+}
+
+func (t *timestampStorage) Touch(mtype, name string, at time.Time) error {
+	if err := t.Storage.Touch(mtype, name, at); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if updated, found := t.updated[mtype]; found {
+		updated[name] = at
+	}
+	return nil
+}
+
+func (t *timestampStorage) UpdatedAt(mtype, name string) (time.Time, bool, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	at, found := t.updated[mtype][name]
+	return at, found, nil
+}
+
+func (t *timestampStorage) DeleteGauge(name string) error {
+	if err := t.Storage.DeleteGauge(name); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.updated["gauge"], name)
+	return nil
+}
+
+func (t *timestampStorage) DeleteGaugeIfNotUpdatedSince(name string, at time.Time) (bool, error) {
+	deleted, err := t.Storage.DeleteGaugeIfNotUpdatedSince(name, at)
+	if err != nil || !deleted {
+		return deleted, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.updated["gauge"], name)
+	return true, nil
+}
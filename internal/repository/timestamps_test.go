@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestampStorage(t *testing.T) {
+	ms := NewInMemoryStorage()
+	ms.SaveGauge("restored", 1)
+	ts, err := MakeStorageWithTimestamps(ms)
+	require.NoError(t, err)
+
+	_, found, err := ts.UpdatedAt("gauge", "restored")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	_, found, _ = ts.UpdatedAt("counter", "restored")
+	assert.False(t, found)
+
+	at := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, ts.Touch("counter", "c1", at))
+	updated, found, _ := ts.UpdatedAt("counter", "c1")
+	assert.True(t, found)
+	assert.Equal(t, at, updated)
+
+	assert.NoError(t, ts.DeleteGauge("restored"))
+	_, found, _ = ts.UpdatedAt("gauge", "restored")
+	assert.False(t, found)
+	_, found, _ = ms.GetGauge("restored")
+	assert.False(t, found)
+}
+
+func TestWALReplaysDeletedGauge(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "db.json")
+
+	ws, err := MakeStorageWithWAL(NewInMemoryStorage(), fname)
+	require.NoError(t, err)
+	ws.SaveGauge("g1", 1)
+	ws.SaveGauge("g2", 2)
+	ws.DeleteGauge("g1")
+
+	restored, err := NewInMemoryStorageFromFile(fname)
+	require.NoError(t, err)
+	_, found, _ := restored.GetGauge("g1")
+	assert.False(t, found)
+	_, found, _ = restored.GetGauge("g2")
+	assert.True(t, found)
+}
+
+func TestTimestampsPersisted(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "db.json")
+	at := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	ws, err := MakeStorageWithWAL(NewInMemoryStorage(), fname)
+	require.NoError(t, err)
+	ts, err := MakeStorageWithTimestamps(ws)
+	require.NoError(t, err)
+	require.NoError(t, ts.SaveGauge("g1", 1))
+	require.NoError(t, ts.Touch("gauge", "g1", at))
+	_, err = ts.SaveBatch(Batch{
+		Counters: map[string]int64{"c1": 1},
+		Updated:  map[string]map[string]time.Time{"counter": {"c1": at}},
+	})
+	require.NoError(t, err)
+
+	updatedAt := func(mtype, name string) time.Time {
+		restored, err := NewInMemoryStorageFromFile(fname)
+		require.NoError(t, err)
+		rs, err := MakeStorageWithTimestamps(restored)
+		require.NoError(t, err)
+		updated, found, err := rs.UpdatedAt(mtype, name)
+		require.NoError(t, err)
+		require.True(t, found)
+		return updated
+	}
+	assert.True(t, at.Equal(updatedAt("gauge", "g1")), "restored from WAL")
+	assert.True(t, at.Equal(updatedAt("counter", "c1")), "batch restored from WAL")
+
+	require.NoError(t, ws.WriteToFile(fname))
+	assert.True(t, at.Equal(updatedAt("gauge", "g1")), "restored from snapshot")
+	assert.True(t, at.Equal(updatedAt("counter", "c1")), "batch restored from snapshot")
+}
+
+func testBatchUpdateTimes(t *testing.T, s Storage) {
+	at := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	_, err := s.SaveBatch(Batch{
+		Counters: map[string]int64{"c1": 1},
+		Gauges:   map[string]float64{"g1": 1},
+		Updated:  map[string]map[string]time.Time{"counter": {"c1": at}},
+	})
+	require.NoError(t, err)
+
+	updated, found, err := s.UpdatedAt("counter", "c1")
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.True(t, at.Equal(updated))
+	updated, found, err = s.UpdatedAt("gauge", "g1")
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.WithinDuration(t, time.Now(), updated, time.Minute)
+}
+
+func TestBatchUpdateTimes(t *testing.T) {
+	testBatchUpdateTimes(t, NewInMemoryStorage())
+	ts, err := MakeStorageWithTimestamps(NewInMemoryStorage())
+	require.NoError(t, err)
+	testBatchUpdateTimes(t, ts)
+}
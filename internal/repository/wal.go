@@ -0,0 +1,271 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/javaman/go-metrics/internal/model"
+)
+
+type walRecord struct {
+	Counters   map[string]int64                `json:"counters,omitempty"`
+	Gauges     map[string]float64              `json:"gauges,omitempty"`
+	Histograms map[string]model.Histogram      `json:"histograms,omitempty"`
+	Deleted    []string                        `json:"deleted_gauges,omitempty"`
+	Updated    map[string]map[string]time.Time `json:"updated,omitempty"`
+}
+
+func walFileName(fname string) string {
+	return fname + ".wal"
+}
+
+func replayWAL(s Storage, walName string) error {
+	data, err := os.ReadFile(walName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var r walRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			// a torn last record means the process died mid-append, the update was never acknowledged
+			if i == len(lines)-1 {
+				return nil
+			}
+			return fmt.Errorf("%s:%d: %w", walName, i+1, err)
+		}
+		for k, v := range r.Counters {
+			if err := s.SaveCounter(k, v); err != nil {
+				return err
+			}
+		}
+		for k, v := range r.Gauges {
+			if err := s.SaveGauge(k, v); err != nil {
+				return err
+			}
+		}
+		for k, v := range r.Histograms {
+			if err := s.SaveHistogram(k, v); err != nil {
+				return err
+			}
+		}
+		for _, k := range r.Deleted {
+			if err := s.DeleteGauge(k); err != nil {
+				return err
+			}
+		}
+		for mtype, updated := range r.Updated {
+			for k, at := range updated {
+				if err := s.Touch(mtype, k, at); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// walStorage applies changes and writes their records under mu, so the log follows the order of changes,
+// and syncs the log outside of it: a Sync covers every record written before it started,
+// so concurrent writers share it (group commit).
+type walStorage struct {
+	Storage
+	mu      sync.Mutex
+	walName string
+	wal     *os.File
+	written uint64
+
+	// syncMu is taken before mu
+	syncMu sync.Mutex
+	synced uint64
+}
+
+func MakeStorageWithWAL(s Storage, fname string) (Storage, error) {
+	w := &walStorage{
+		Storage: s,
+		walName: walFileName(fname),
+	}
+	if err := w.WriteToFile(fname); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *walStorage) append(r walRecord) (uint64, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return 0, err
+	}
+	if w.wal == nil {
+		return 0, os.ErrClosed
+	}
+	if _, err := w.wal.Write(append(data, '\n')); err != nil {
+		return 0, err
+	}
+	w.written++
+	return w.written, nil
+}
+
+// sync returns once the record with the given sequence number is on disk.
+func (w *walStorage) sync(seq uint64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	if w.synced >= seq {
+		return nil
+	}
+	w.mu.Lock()
+	wal, written := w.wal, w.written
+	w.mu.Unlock()
+	if err := wal.Sync(); err != nil {
+		return err
+	}
+	w.synced = written
+	return nil
+}
+
+// change calls f under mu and logs the record it returns, if any, then waits for the record to be synced.
+func (w *walStorage) change(f func() (*walRecord, error)) error {
+	seq, err := func() (uint64, error) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		r, err := f()
+		if err != nil || r == nil {
+			return 0, err
+		}
+		return w.append(*r)
+	}()
+	if err != nil || seq == 0 {
+		return err
+	}
+	return w.sync(seq)
+}
+
+func (w *walStorage) SaveGauge(name string, v float64) error {
+	return w.change(func() (*walRecord, error) {
+		if err := w.Storage.SaveGauge(name, v); err != nil {
+			return nil, err
+		}
+		return &walRecord{Gauges: map[string]float64{name: v}}, nil
+	})
+}
+
+func (w *walStorage) DeleteGauge(name string) error {
+	return w.change(func() (*walRecord, error) {
+		if err := w.Storage.DeleteGauge(name); err != nil {
+			return nil, err
+		}
+		return &walRecord{Deleted: []string{name}}, nil
+	})
+}
+
+func (w *walStorage) DeleteGaugeIfNotUpdatedSince(name string, at time.Time) (bool, error) {
+	var deleted bool
+	err := w.change(func() (*walRecord, error) {
+		var err error
+		deleted, err = w.Storage.DeleteGaugeIfNotUpdatedSince(name, at)
+		if err != nil || !deleted {
+			return nil, err
+		}
+		return &walRecord{Deleted: []string{name}}, nil
+	})
+	return deleted, err
+}
+
+func (w *walStorage) SaveCounter(name string, v int64) error {
+	return w.change(func() (*walRecord, error) {
+		if err := w.Storage.SaveCounter(name, v); err != nil {
+			return nil, err
+		}
+		return &walRecord{Counters: map[string]int64{name: v}}, nil
+	})
+}
+
+func (w *walStorage) IncrementCounter(name string, delta int64) (int64, error) {
+	var result int64
+	err := w.change(func() (*walRecord, error) {
+		var err error
+		result, err = w.Storage.IncrementCounter(name, delta)
+		if err != nil {
+			return nil, err
+		}
+		return &walRecord{Counters: map[string]int64{name: result}}, nil
+	})
+	return result, err
+}
+
+func (w *walStorage) Touch(mtype, name string, at time.Time) error {
+	return w.change(func() (*walRecord, error) {
+		if err := w.Storage.Touch(mtype, name, at); err != nil {
+			return nil, err
+		}
+		return &walRecord{Updated: map[string]map[string]time.Time{mtype: {name: at}}}, nil
+	})
+}
+
+func (w *walStorage) SaveHistogram(name string, h model.Histogram) error {
+	return w.change(func() (*walRecord, error) {
+		if err := w.Storage.SaveHistogram(name, h); err != nil {
+			return nil, err
+		}
+		return &walRecord{Histograms: map[string]model.Histogram{name: h}}, nil
+	})
+}
+
+func (w *walStorage) MergeHistogram(name string, delta model.Histogram) (model.Histogram, error) {
+	var result model.Histogram
+	err := w.change(func() (*walRecord, error) {
+		var err error
+		result, err = w.Storage.MergeHistogram(name, delta)
+		if err != nil {
+			return nil, err
+		}
+		return &walRecord{Histograms: map[string]model.Histogram{name: result}}, nil
+	})
+	return result, err
+}
+
+func (w *walStorage) SaveBatch(deltas Batch) (Batch, error) {
+	var result Batch
+	err := w.change(func() (*walRecord, error) {
+		var err error
+		result, err = w.Storage.SaveBatch(deltas)
+		if err != nil {
+			return nil, err
+		}
+		return &walRecord{Counters: result.Counters, Gauges: result.Gauges, Histograms: result.Histograms, Updated: result.Updated}, nil
+	})
+	return result, err
+}
+
+// WriteToFile snapshots the storage and starts a new log, the snapshot covers every record written so far.
+func (w *walStorage) WriteToFile(fname string) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.Storage.WriteToFile(fname); err != nil {
+		return err
+	}
+	w.synced = w.written
+	if w.wal != nil {
+		w.wal.Close()
+	}
+	wal, err := os.OpenFile(w.walName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		w.wal = nil
+		return err
+	}
+	w.wal = wal
+	return nil
+}
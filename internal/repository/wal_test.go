@@ -0,0 +1,137 @@
+package repository
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWALReplayedOnRestore(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "db.json")
+
+	ws, err := MakeStorageWithWAL(NewInMemoryStorage(), fname)
+	require.NoError(t, err)
+	ws.SaveGauge("g1", 3.14)
+	ws.IncrementCounter("c1", 40)
+	ws.IncrementCounter("c1", 2)
+	ws.SaveBatch(Batch{Counters: map[string]int64{"c2": 7}, Gauges: map[string]float64{"g2": 2.72}})
+	delta := model.NewHistogram([]float64{1})
+	delta.Observe(0.5)
+	ws.MergeHistogram("h1", delta)
+	ws.MergeHistogram("h1", delta)
+
+	restored, err := NewInMemoryStorageFromFile(fname)
+	require.NoError(t, err)
+	g1, _, _ := restored.GetGauge("g1")
+	assert.Equal(t, 3.14, g1)
+	g2, _, _ := restored.GetGauge("g2")
+	assert.Equal(t, 2.72, g2)
+	c1, _, _ := restored.GetCounter("c1")
+	assert.Equal(t, int64(42), c1)
+	c2, _, _ := restored.GetCounter("c2")
+	assert.Equal(t, int64(7), c2)
+	h1, _, _ := restored.GetHistogram("h1")
+	assert.Equal(t, uint64(2), h1.Count)
+}
+
+func TestWALCompaction(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "db.json")
+
+	ws, err := MakeStorageWithWAL(NewInMemoryStorage(), fname)
+	require.NoError(t, err)
+	ws.IncrementCounter("c1", 1)
+
+	info, err := os.Stat(walFileName(fname))
+	require.NoError(t, err)
+	assert.Positive(t, info.Size())
+
+	require.NoError(t, ws.WriteToFile(fname))
+	info, err = os.Stat(walFileName(fname))
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	ws.IncrementCounter("c1", 1)
+	restored, err := NewInMemoryStorageFromFile(fname)
+	require.NoError(t, err)
+	c1, _, _ := restored.GetCounter("c1")
+	assert.Equal(t, int64(2), c1)
+}
+
+func TestWALTornRecord(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "db.json")
+	wal := `{"gauges":{"g1":1}}` + "\n" + `{"gauges":{"g1":`
+	require.NoError(t, os.WriteFile(walFileName(fname), []byte(wal), 0644))
+
+	restored, err := NewInMemoryStorageFromFile(fname)
+	require.NoError(t, err)
+	g1, _, _ := restored.GetGauge("g1")
+	assert.Equal(t, float64(1), g1)
+}
+
+func TestWALCorrupted(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "db.json")
+	wal := `garbage` + "\n" + `{"gauges":{"g1":1}}` + "\n"
+	require.NoError(t, os.WriteFile(walFileName(fname), []byte(wal), 0644))
+
+	_, err := NewInMemoryStorageFromFile(fname)
+	assert.Error(t, err)
+}
+
+func TestFlushedOnEachCallRemovesWAL(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "db.json")
+	require.NoError(t, os.WriteFile(walFileName(fname), []byte(`{"gauges":{"g1":1}}`+"\n"), 0644))
+
+	restored, err := NewInMemoryStorageFromFile(fname)
+	require.NoError(t, err)
+	_, err = MakeStorageFlushedOnEachCall(restored, fname)
+	require.NoError(t, err)
+
+	_, err = os.Stat(walFileName(fname))
+	assert.True(t, os.IsNotExist(err))
+
+	again, err := NewInMemoryStorageFromFile(fname)
+	require.NoError(t, err)
+	g1, found, _ := again.GetGauge("g1")
+	assert.True(t, found)
+	assert.Equal(t, float64(1), g1)
+}
+
+func TestWALConcurrentWrites(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "db.json")
+	ws, err := MakeStorageWithWAL(NewInMemoryStorage(), fname)
+	require.NoError(t, err)
+
+	const goroutines = 16
+	const iterations = 50
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				assert.NoError(t, ws.SaveGauge(fmt.Sprintf("g%d", i), float64(j)))
+				_, err := ws.IncrementCounter("c", 1)
+				assert.NoError(t, err)
+				if j == iterations/2 && i == 0 {
+					assert.NoError(t, ws.WriteToFile(fname))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	restored, err := NewInMemoryStorageFromFile(fname)
+	require.NoError(t, err)
+	c, _, _ := restored.GetCounter("c")
+	assert.Equal(t, int64(goroutines*iterations), c)
+	for i := 0; i < goroutines; i++ {
+		g, _, _ := restored.GetGauge(fmt.Sprintf("g%d", i))
+		assert.Equal(t, float64(iterations-1), g)
+	}
+}
@@ -0,0 +1,24 @@
+package retry
+
+import (
+	"context"
+	"time"
+)
+
+var DefaultDelays = []time.Duration{time.Second, 3 * time.Second, 5 * time.Second}
+
+func Do(ctx context.Context, delays []time.Duration, isRetriable func(error) bool, f func() error) error {
+	err := f()
+	for _, delay := range delays {
+		if err == nil || !isRetriable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		err = f()
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	errTransient = errors.New("transient")
+	errFatal     = errors.New("fatal")
+)
+
+func isTransient(err error) bool {
+	return errors.Is(err, errTransient)
+}
+
+func TestDoRetriesTransient(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), []time.Duration{time.Millisecond, time.Millisecond}, isTransient, func() error {
+		calls++
+		if calls < 3 {
+			return errTransient
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestDoGivesUp(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), []time.Duration{time.Millisecond, time.Millisecond}, isTransient, func() error {
+		calls++
+		return errTransient
+	})
+	assert.ErrorIs(t, err, errTransient)
+	assert.Equal(t, 3, calls)
+}
+
+func TestDoStopsOnFatal(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), []time.Duration{time.Millisecond}, isTransient, func() error {
+		calls++
+		return errFatal
+	})
+	assert.ErrorIs(t, err, errFatal)
+	assert.Equal(t, 1, calls)
+}
+
+func TestDoCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := 0
+	err := Do(ctx, []time.Duration{time.Hour}, isTransient, func() error {
+		calls++
+		return errTransient
+	})
+	assert.ErrorIs(t, err, errTransient)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,353 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/javaman/go-metrics/internal/repository"
+)
+
+const ConditionNotIncreasing = "not_increasing"
+
+var comparisons = map[string]func(v, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+// AlertRule fires when Condition holds on the metric for at least For.
+// Condition is a comparison with Threshold or not_increasing.
+type AlertRule struct {
+	Name      string            `json:"name"`
+	Metric    string            `json:"metric"`
+	MType     string            `json:"type"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Condition string            `json:"condition"`
+	Threshold float64           `json:"threshold"`
+	For       time.Duration     `json:"-"`
+}
+
+func (r *AlertRule) validate() error {
+	if r.Name == "" {
+		return errors.New("rule name is required")
+	}
+	if r.Metric == "" {
+		return fmt.Errorf("rule %s: metric is required", r.Name)
+	}
+	if r.MType != "gauge" && r.MType != "counter" {
+		return fmt.Errorf("rule %s: %w", r.Name, ErrInvalidMType)
+	}
+	for k := range r.Labels {
+		if !model.ValidLabelName(k) {
+			return fmt.Errorf("rule %s: %w", r.Name, ErrInvalidLabels)
+		}
+	}
+	if _, ok := comparisons[r.Condition]; !ok && r.Condition != ConditionNotIncreasing {
+		return fmt.Errorf("rule %s: unknown condition %q", r.Name, r.Condition)
+	}
+	if r.For < 0 {
+		return fmt.Errorf("rule %s: negative for", r.Name)
+	}
+	return nil
+}
+
+func ParseAlertRules(data []byte) ([]AlertRule, error) {
+	var raw []struct {
+		AlertRule
+		For string `json:"for"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	rules := make([]AlertRule, 0, len(raw))
+	names := make(map[string]bool)
+	for _, r := range raw {
+		rule := r.AlertRule
+		if r.For != "" {
+			d, err := time.ParseDuration(r.For)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+			rule.For = d
+		}
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %s is defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func LoadAlertRules(path string) ([]AlertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAlertRules(data)
+}
+
+type alertState struct {
+	model.Alert
+	LastValue    *float64   `json:"last_value,omitempty"`
+	LastIncrease *time.Time `json:"last_increase,omitempty"`
+}
+
+type AlertEngine struct {
+	mu        sync.Mutex
+	service   MetricsService
+	rules     []AlertRule
+	statePath string
+	now       func() time.Time
+	states    map[string]*alertState
+	observers []func(model.Alert)
+}
+
+func newAlertState(rule *AlertRule, labels map[string]string) *alertState {
+	return &alertState{Alert: model.Alert{Rule: rule.Name, Metric: rule.Metric, Labels: labels, State: model.AlertInactive}}
+}
+
+// NewAlertEngine restores alert state from statePath, if it exists, for series that still match a defined rule.
+// States are kept per rule and series; a rule without any series has one state for its own labels.
+func NewAlertEngine(service MetricsService, rules []AlertRule, statePath string) (*AlertEngine, error) {
+	e := &AlertEngine{
+		service:   service,
+		rules:     rules,
+		statePath: statePath,
+		now:       time.Now,
+		states:    make(map[string]*alertState),
+	}
+	saved := make(map[string]*alertState)
+	if statePath != "" {
+		data, err := os.ReadFile(statePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &saved); err != nil {
+				return nil, fmt.Errorf("%s: %w", statePath, err)
+			}
+		}
+	}
+	byName := make(map[string]*AlertRule, len(rules))
+	for i := range rules {
+		byName[rules[i].Name] = &rules[i]
+	}
+	for _, st := range saved {
+		rule, ok := byName[st.Rule]
+		if !ok || !model.MatchLabels(st.Labels, rule.Labels) {
+			continue
+		}
+		st.Metric = rule.Metric
+		e.states[st.Key()] = st
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if len(e.ruleStates(rule)) == 0 {
+			st := newAlertState(rule, rule.Labels)
+			e.states[st.Key()] = st
+		}
+	}
+	return e, nil
+}
+
+// ruleStates returns the states of the rule sorted by series.
+func (e *AlertEngine) ruleStates(rule *AlertRule) []*alertState {
+	var result []*alertState
+	for _, st := range e.states {
+		if st.Rule == rule.Name {
+			result = append(result, st)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key() < result[j].Key() })
+	return result
+}
+
+type alertSeries struct {
+	labels map[string]string
+	value  float64
+	found  bool
+}
+
+// series returns the values of every stored series matching the rule, keyed by alert key.
+// Stale gauges are left out, so alerts on agents that stopped reporting resolve as if the series were gone.
+func series(rule *AlertRule, metrics []model.Metrics) map[string]alertSeries {
+	result := make(map[string]alertSeries)
+	for _, m := range metrics {
+		if m.ID != rule.Metric || m.MType != rule.MType || !model.MatchLabels(m.Labels, rule.Labels) || m.Stale {
+			continue
+		}
+		var v float64
+		if m.MType == "counter" {
+			v = float64(*m.Delta)
+		} else {
+			v = *m.Value
+		}
+		result[model.MetricKey(rule.Name, m.Labels)] = alertSeries{m.Labels, v, true}
+	}
+	if len(result) == 0 {
+		result[model.MetricKey(rule.Name, rule.Labels)] = alertSeries{labels: rule.Labels}
+	}
+	return result
+}
+
+// check reports whether the rule's condition holds and since when.
+func check(rule *AlertRule, st *alertState, v float64, found bool, now time.Time) (bool, time.Time) {
+	if rule.Condition != ConditionNotIncreasing {
+		return found && comparisons[rule.Condition](v, rule.Threshold), now
+	}
+	increased := false
+	if found {
+		increased = st.LastValue == nil || v > *st.LastValue
+		st.LastValue = &v
+	}
+	if increased || st.LastIncrease == nil {
+		st.LastIncrease = &now
+	}
+	return !increased, *st.LastIncrease
+}
+
+func advance(rule *AlertRule, st *alertState, active bool, since, now time.Time) {
+	if !active {
+		switch st.State {
+		case model.AlertFiring:
+			st.State = model.AlertResolved
+			st.ResolvedAt = &now
+		case model.AlertPending:
+			st.State = model.AlertInactive
+			st.ActiveSince = nil
+		}
+		return
+	}
+	if st.State != model.AlertPending && st.State != model.AlertFiring {
+		st.State = model.AlertPending
+		st.ActiveSince = &since
+		st.FiredAt = nil
+		st.ResolvedAt = nil
+	}
+	if st.State == model.AlertPending && now.Sub(*st.ActiveSince) >= rule.For {
+		st.State = model.AlertFiring
+		st.FiredAt = &now
+	}
+}
+
+// Subscribe registers f to be called after each evaluation for every alert that started firing or resolved.
+func (e *AlertEngine) Subscribe(f func(model.Alert)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.observers = append(e.observers, f)
+}
+
+func (e *AlertEngine) Evaluate() error {
+	changed, observers, err := e.evaluate()
+	for _, a := range changed {
+		for _, f := range observers {
+			f(a)
+		}
+	}
+	return err
+}
+
+func (e *AlertEngine) evaluate() ([]model.Alert, []func(model.Alert), error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	metrics, err := e.service.AllMetrics(nil)
+	if err != nil {
+		return nil, e.observers, err
+	}
+	now := e.now()
+	var changed []model.Alert
+	for i := range e.rules {
+		rule := &e.rules[i]
+		current := series(rule, metrics)
+		for key, s := range current {
+			if _, ok := e.states[key]; !ok {
+				e.states[key] = newAlertState(rule, s.labels)
+			}
+		}
+		for _, st := range e.ruleStates(rule) {
+			key := st.Key()
+			s, ok := current[key]
+			previous := st.State
+			if ok {
+				active, since := check(rule, st, s.value, s.found, now)
+				advance(rule, st, active, since, now)
+			} else {
+				// The series is gone while others still match: resolve its alert and forget it.
+				advance(rule, st, false, now, now)
+			}
+			st.Value = nil
+			if s.found {
+				v := s.value
+				st.Value = &v
+			}
+			if st.State != previous && (st.State == model.AlertFiring || st.State == model.AlertResolved) {
+				changed = append(changed, st.Alert)
+			}
+			if !ok && (st.State == model.AlertInactive || previous == model.AlertResolved) {
+				delete(e.states, key)
+			}
+		}
+	}
+	return changed, e.observers, e.save()
+}
+
+func (e *AlertEngine) save() error {
+	if e.statePath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(e.states, "", "   ")
+	if err != nil {
+		return err
+	}
+	return repository.WriteFileAtomic(e.statePath, data)
+}
+
+// Alerts returns the current state of every rule and series, rules in the order they were defined.
+func (e *AlertEngine) Alerts() []model.Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result := make([]model.Alert, 0, len(e.states))
+	for i := range e.rules {
+		for _, st := range e.ruleStates(&e.rules[i]) {
+			result = append(result, st.Alert)
+		}
+	}
+	return result
+}
+
+func EvaluateAlertsInBackground(ctx context.Context, engine *AlertEngine, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := engine.Evaluate(); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}()
+	return done
+}
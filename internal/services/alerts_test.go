@@ -0,0 +1,168 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/javaman/go-metrics/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `[
+	{"name": "HighHeap", "metric": "HeapAlloc", "type": "gauge", "condition": ">", "threshold": 524288000, "for": "2m"},
+	{"name": "PollStuck", "metric": "PollCount", "type": "counter", "condition": "not_increasing", "for": "5m"}
+]`
+
+func TestParseAlertRules(t *testing.T) {
+	rules, err := ParseAlertRules([]byte(testRules))
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(rules))
+	assert.Equal(t, 2*time.Minute, rules[0].For)
+	assert.Equal(t, ConditionNotIncreasing, rules[1].Condition)
+
+	invalid := []string{
+		`not a json`,
+		`[{"metric": "m", "type": "gauge", "condition": ">"}]`,
+		`[{"name": "a", "metric": "m", "type": "histogram", "condition": ">"}]`,
+		`[{"name": "a", "metric": "m", "type": "gauge", "condition": "~"}]`,
+		`[{"name": "a", "metric": "m", "type": "gauge", "condition": ">", "for": "soon"}]`,
+		`[{"name": "a", "metric": "m", "type": "gauge", "condition": ">"}, {"name": "a", "metric": "n", "type": "gauge", "condition": "<"}]`,
+	}
+	for _, data := range invalid {
+		_, err := ParseAlertRules([]byte(data))
+		assert.Error(t, err, data)
+	}
+}
+
+func states(alerts []model.Alert) []string {
+	var result []string
+	for _, a := range alerts {
+		result = append(result, a.State)
+	}
+	return result
+}
+
+func TestAlertEngine(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "alerts.json")
+	rules, err := ParseAlertRules([]byte(testRules))
+	require.NoError(t, err)
+
+	service := NewMetricsService(repository.NewInMemoryStorage())
+	engine, err := NewAlertEngine(service, rules, statePath)
+	require.NoError(t, err)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	engine.now = func() time.Time { return now }
+	var notified []string
+	engine.Subscribe(func(a model.Alert) { notified = append(notified, a.Rule+" "+a.State) })
+
+	step := func(heap float64, polls int64) []string {
+		require.NoError(t, service.SaveGauge("HeapAlloc", heap))
+		_, err := service.SaveCounter("PollCount", polls)
+		require.NoError(t, err)
+		require.NoError(t, engine.Evaluate())
+		now = now.Add(time.Minute)
+		return states(engine.Alerts())
+	}
+
+	assert.Equal(t, []string{model.AlertPending, model.AlertInactive}, step(600e6, 1))
+	assert.Equal(t, []string{model.AlertPending, model.AlertInactive}, step(600e6, 1))
+	assert.Equal(t, []string{model.AlertFiring, model.AlertPending}, step(600e6, 0))
+	assert.Equal(t, []string{model.AlertResolved, model.AlertPending}, step(100e6, 0))
+	assert.Equal(t, []string{model.AlertPending, model.AlertPending}, step(600e6, 0))
+	assert.Equal(t, []string{model.AlertInactive, model.AlertPending}, step(100e6, 0))
+
+	assert.Equal(t, []string{"HighHeap firing", "HighHeap resolved"}, notified)
+
+	alerts := engine.Alerts()
+	assert.Equal(t, "HighHeap", alerts[0].Rule)
+	assert.Equal(t, "HeapAlloc", alerts[0].Metric)
+	assert.Equal(t, 100e6, *alerts[0].Value)
+	assert.Equal(t, 2.0, *alerts[1].Value)
+	assert.Nil(t, alerts[0].ActiveSince)
+
+	restored, err := NewAlertEngine(service, rules, statePath)
+	require.NoError(t, err)
+	restored.now = func() time.Time { return now }
+	assert.Equal(t, alerts, restored.Alerts())
+
+	// PollCount last increased at the second evaluation, six minutes before this one.
+	now = now.Add(time.Minute)
+	require.NoError(t, restored.Evaluate())
+	assert.Equal(t, model.AlertFiring, restored.Alerts()[1].State)
+
+	_, err = service.SaveCounter("PollCount", 1)
+	require.NoError(t, err)
+	require.NoError(t, restored.Evaluate())
+	assert.Equal(t, model.AlertResolved, restored.Alerts()[1].State)
+}
+
+func TestAlertEngineMissingMetric(t *testing.T) {
+	rules, err := ParseAlertRules([]byte(`[{"name": "Low", "metric": "Free", "type": "gauge", "labels": {"host": "a"}, "condition": "<", "threshold": 10}]`))
+	require.NoError(t, err)
+
+	service := NewMetricsService(repository.NewInMemoryStorage())
+	engine, err := NewAlertEngine(service, rules, "")
+	require.NoError(t, err)
+
+	require.NoError(t, engine.Evaluate())
+	assert.Equal(t, []string{model.AlertInactive}, states(engine.Alerts()))
+	assert.Nil(t, engine.Alerts()[0].Value)
+
+	_, err = service.Save(&model.Metrics{ID: "Free", MType: "gauge", Value: new(float64), Labels: map[string]string{"host": "a"}})
+	require.NoError(t, err)
+	require.NoError(t, engine.Evaluate())
+	assert.Equal(t, []string{model.AlertFiring}, states(engine.Alerts()))
+}
+
+func TestAlertEngineSeries(t *testing.T) {
+	rules, err := ParseAlertRules([]byte(`[{"name": "HighHeap", "metric": "HeapAlloc", "type": "gauge", "condition": ">", "threshold": 10}]`))
+	require.NoError(t, err)
+
+	storage := repository.NewInMemoryStorage()
+	service := NewMetricsService(storage)
+	engine, err := NewAlertEngine(service, rules, "")
+	require.NoError(t, err)
+	save := func(host string, v float64) {
+		_, err := service.Save(&model.Metrics{ID: "HeapAlloc", MType: "gauge", Value: &v, Labels: map[string]string{"host": host}})
+		require.NoError(t, err)
+	}
+
+	save("a", 20)
+	save("b", 5)
+	require.NoError(t, engine.Evaluate())
+	alerts := engine.Alerts()
+	require.Equal(t, 2, len(alerts))
+	assert.Equal(t, map[string]string{"host": "a"}, alerts[0].Labels)
+	assert.Equal(t, []string{model.AlertFiring, model.AlertInactive}, states(alerts))
+
+	require.NoError(t, storage.DeleteGauge(`HeapAlloc{host="a"}`))
+	require.NoError(t, engine.Evaluate())
+	assert.Equal(t, []string{model.AlertResolved, model.AlertInactive}, states(engine.Alerts()))
+	require.NoError(t, engine.Evaluate())
+	assert.Equal(t, []string{model.AlertInactive}, states(engine.Alerts()))
+	assert.Equal(t, map[string]string{"host": "b"}, engine.Alerts()[0].Labels)
+}
+
+func TestAlertEngineStaleSeries(t *testing.T) {
+	rules, err := ParseAlertRules([]byte(`[{"name": "HighHeap", "metric": "HeapAlloc", "type": "gauge", "condition": ">", "threshold": 10}]`))
+	require.NoError(t, err)
+
+	storage := repository.NewInMemoryStorage()
+	service := NewMetricsServiceWithTTL(storage, time.Minute)
+	engine, err := NewAlertEngine(service, rules, "")
+	require.NoError(t, err)
+	for _, host := range []string{"a", "b"} {
+		v := 20.0
+		_, err := service.Save(&model.Metrics{ID: "HeapAlloc", MType: "gauge", Value: &v, Labels: map[string]string{"host": host}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, engine.Evaluate())
+	assert.Equal(t, []string{model.AlertFiring, model.AlertFiring}, states(engine.Alerts()))
+
+	require.NoError(t, storage.Touch("gauge", `HeapAlloc{host="a"}`, time.Now().Add(-time.Hour)))
+	require.NoError(t, engine.Evaluate())
+	assert.Equal(t, []string{model.AlertResolved, model.AlertFiring}, states(engine.Alerts()))
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/javaman/go-metrics/internal/repository"
+)
+
+var (
+	ErrInvalidQuery  error = errors.New("invalid list query")
+	ErrInvalidCursor error = errors.New("invalid cursor")
+)
+
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// ListQuery selects metrics by type and by name (the metric ID without labels).
+// Metrics are ordered by their labelled key and type; Cursor continues a previous page.
+type ListQuery struct {
+	Types  []string
+	Prefix string
+	Glob   string
+	Regex  string
+	Desc   bool
+	Limit  int
+	Cursor string
+}
+
+type MetricsPage struct {
+	Metrics    []model.Metrics `json:"metrics"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+type listCursor struct {
+	Key   string `json:"key"`
+	MType string `json:"type"`
+	Desc  bool   `json:"desc"`
+}
+
+func encodeCursor(c listCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (listCursor, error) {
+	var c listCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil || c.Key == "" {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+type listFilter struct {
+	types  map[string]bool
+	prefix string
+	glob   string
+	regex  *regexp.Regexp
+}
+
+func newListFilter(q ListQuery) (*listFilter, error) {
+	f := &listFilter{prefix: q.Prefix, glob: q.Glob}
+	if len(q.Types) > 0 {
+		f.types = make(map[string]bool)
+		for _, t := range q.Types {
+			if t != "gauge" && t != "counter" && t != "histogram" {
+				return nil, ErrInvalidMType
+			}
+			f.types[t] = true
+		}
+	}
+	if _, err := path.Match(q.Glob, ""); err != nil {
+		return nil, ErrInvalidQuery
+	}
+	if q.Regex != "" {
+		re, err := regexp.Compile(q.Regex)
+		if err != nil {
+			return nil, ErrInvalidQuery
+		}
+		f.regex = re
+	}
+	return f, nil
+}
+
+func (f *listFilter) match(m *model.Metrics) bool {
+	if f.types != nil && !f.types[m.MType] {
+		return false
+	}
+	if !strings.HasPrefix(m.ID, f.prefix) {
+		return false
+	}
+	if f.glob != "" {
+		if ok, _ := path.Match(f.glob, m.ID); !ok {
+			return false
+		}
+	}
+	return f.regex == nil || f.regex.MatchString(m.ID)
+}
+
+func (dm *defaultMetricsService) ListMetrics(q ListQuery) (*MetricsPage, error) {
+	filter, err := newListFilter(q)
+	if err != nil {
+		return nil, err
+	}
+	limit := q.Limit
+	switch {
+	case limit < 0:
+		return nil, ErrInvalidQuery
+	case limit == 0:
+		limit = DefaultListLimit
+	case limit > MaxListLimit:
+		limit = MaxListLimit
+	}
+
+	var after repository.ScanPosition
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if c.Desc != q.Desc {
+			return nil, ErrInvalidCursor
+		}
+		after = repository.ScanPosition{Key: c.Key, MType: c.MType}
+	}
+	// Every key of a metric whose name has the prefix sorts at or after the prefix itself,
+	// so an ascending scan can start there.
+	if !q.Desc && q.Prefix != "" && after.Key < q.Prefix {
+		after = repository.ScanPosition{Key: q.Prefix}
+	}
+
+	page := &MetricsPage{Metrics: []model.Metrics{}}
+	var keys []string
+	var scanErr error
+	err = dm.storage.Scan(after, q.Desc, func(m model.Metrics) bool {
+		key := m.ID
+		if q.Prefix != "" && !strings.HasPrefix(key, q.Prefix) && (key > q.Prefix) != q.Desc {
+			return false
+		}
+		m.ID, m.Labels, scanErr = model.ParseMetricKey(key)
+		if scanErr != nil {
+			return false
+		}
+		if !filter.match(&m) {
+			return true
+		}
+		if scanErr = dm.addTimestamp(&m, key); scanErr != nil {
+			return false
+		}
+		page.Metrics = append(page.Metrics, m)
+		keys = append(keys, key)
+		return len(page.Metrics) <= limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	if scanErr != nil {
+		return nil, scanErr
+	}
+	if len(page.Metrics) > limit {
+		last := page.Metrics[limit-1]
+		page.Metrics = page.Metrics[:limit]
+		page.NextCursor = encodeCursor(listCursor{Key: keys[limit-1], MType: last.MType, Desc: q.Desc})
+	}
+	return page, nil
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/javaman/go-metrics/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func keys(page *MetricsPage) []string {
+	var result []string
+	for _, m := range page.Metrics {
+		result = append(result, m.MType+" "+m.Key())
+	}
+	return result
+}
+
+func TestListMetrics(t *testing.T) {
+	storage, err := repository.MakeStorageWithTimestamps(repository.NewInMemoryStorage())
+	require.NoError(t, err)
+	service := NewMetricsService(storage)
+
+	for _, name := range []string{"Alloc", "HeapAlloc", "HeapIdle", "HeapInuse", "NumGC"} {
+		v := 1.0
+		_, err := service.Save(&model.Metrics{ID: name, MType: "gauge", Value: &v})
+		require.NoError(t, err)
+	}
+	delta := int64(1)
+	_, err = service.Save(&model.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+	require.NoError(t, err)
+	_, err = service.Save(&model.Metrics{ID: "HeapAlloc", MType: "gauge", Value: new(float64), Labels: map[string]string{"host": "a"}})
+	require.NoError(t, err)
+
+	page, err := service.ListMetrics(ListQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gauge Alloc", "gauge HeapAlloc", `gauge HeapAlloc{host="a"}`, "gauge HeapIdle", "gauge HeapInuse", "gauge NumGC", "counter PollCount"}, keys(page))
+	assert.Empty(t, page.NextCursor)
+	assert.NotNil(t, page.Metrics[0].Timestamp)
+	assert.Equal(t, map[string]string{"host": "a"}, page.Metrics[2].Labels)
+
+	page, err = service.ListMetrics(ListQuery{Types: []string{"counter"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"counter PollCount"}, keys(page))
+
+	page, err = service.ListMetrics(ListQuery{Prefix: "Heap", Desc: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gauge HeapInuse", "gauge HeapIdle", `gauge HeapAlloc{host="a"}`, "gauge HeapAlloc"}, keys(page))
+
+	page, err = service.ListMetrics(ListQuery{Glob: "*Alloc"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gauge Alloc", "gauge HeapAlloc", `gauge HeapAlloc{host="a"}`}, keys(page))
+
+	page, err = service.ListMetrics(ListQuery{Regex: "^(Num|Poll)"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gauge NumGC", "counter PollCount"}, keys(page))
+
+	var all []string
+	q := ListQuery{Prefix: "Heap", Limit: 3}
+	for i := 0; ; i++ {
+		require.Less(t, i, 10)
+		page, err = service.ListMetrics(q)
+		require.NoError(t, err)
+		all = append(all, keys(page)...)
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	assert.Equal(t, []string{"gauge HeapAlloc", `gauge HeapAlloc{host="a"}`, "gauge HeapIdle", "gauge HeapInuse"}, all)
+
+	page, err = service.ListMetrics(ListQuery{Desc: true, Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"counter PollCount", "gauge NumGC"}, keys(page))
+	page, err = service.ListMetrics(ListQuery{Desc: true, Limit: 2, Cursor: page.NextCursor})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gauge HeapInuse", "gauge HeapIdle"}, keys(page))
+
+	_, err = service.ListMetrics(ListQuery{Cursor: page.NextCursor})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+	_, err = service.ListMetrics(ListQuery{Cursor: "garbage"})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+	_, err = service.ListMetrics(ListQuery{Regex: "("})
+	assert.ErrorIs(t, err, ErrInvalidQuery)
+	_, err = service.ListMetrics(ListQuery{Glob: "["})
+	assert.ErrorIs(t, err, ErrInvalidQuery)
+	_, err = service.ListMetrics(ListQuery{Types: []string{"summary"}})
+	assert.ErrorIs(t, err, ErrInvalidMType)
+}
@@ -1,7 +1,10 @@
 package services
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log"
 	"strings"
 	"time"
 
@@ -11,131 +14,532 @@ import (
 )
 
 var (
-	ErrIDRequired    error = errors.New("ID Required")
-	ErrInvalidMType  error = errors.New("MType must be counter or delta")
-	ErrDeltaRequired error = errors.New("delta is required")
-	ErrValueRequired error = errors.New("dalue is required")
-	ErrIDNotFound    error = errors.New("ID not found")
+	ErrIDRequired        error = errors.New("ID Required")
+	ErrInvalidMType      error = errors.New("MType must be counter, gauge or histogram")
+	ErrDeltaRequired     error = errors.New("delta is required")
+	ErrValueRequired     error = errors.New("dalue is required")
+	ErrIDNotFound        error = errors.New("ID not found")
+	ErrInvalidLabels     error = errors.New("invalid labels")
+	ErrHistogramRequired error = errors.New("histogram is required")
+	ErrInvalidHistogram  error = model.ErrInvalidHistogram
+	ErrHistoryDisabled   error = repository.ErrHistoryDisabled
+	// ErrNotApplied wraps storage failures of updates that are known not to be applied, so they may be sent again.
+	ErrNotApplied error = errors.New("update was not applied")
 )
 
+const maxHistoryPoints = 1000
+
 type MetricsService interface {
-	SaveGauge(name string, v float64)
-	GetGauge(name string) (float64, bool)
-	AllGauges(func(string, float64))
-	SaveCounter(name string, v int64) int64
-	GetCounter(name string) (int64, bool)
-	AllCounters(func(string, int64))
+	SaveGauge(name string, v float64) error
+	GetGauge(name string) (float64, bool, error)
+	AllGauges(func(string, float64)) error
+	SaveCounter(name string, v int64) (int64, error)
+	GetCounter(name string) (int64, bool, error)
+	AllCounters(func(string, int64)) error
+	GetHistogram(name string) (model.Histogram, bool, error)
+	AllHistograms(func(string, model.Histogram)) error
 	Save(m *model.Metrics) (*model.Metrics, error)
 	Value(m *model.Metrics) (*model.Metrics, error)
+	SaveBatch(ms []model.Metrics) ([]model.Metrics, error)
+	AllMetrics(filter map[string]string) ([]model.Metrics, error)
+	History(m *model.Metrics, from, to time.Time, step time.Duration) ([]model.Point, error)
+	ListMetrics(q ListQuery) (*MetricsPage, error)
+	Ping() error
 }
 
 type defaultMetricsService struct {
 	storage   repository.Storage
 	validator *validator.Validate
+	ttl       time.Duration
 }
 
-func (dm *defaultMetricsService) SaveGauge(name string, v float64) {
-	dm.storage.SaveGauge(name, v)
+func (dm *defaultMetricsService) SaveGauge(name string, v float64) error {
+	return dm.storage.SaveGauge(name, v)
 }
 
-func (dm *defaultMetricsService) GetGauge(name string) (float64, bool) {
+func (dm *defaultMetricsService) GetGauge(name string) (float64, bool, error) {
 	return dm.storage.GetGauge(name)
 }
 
-func (dm *defaultMetricsService) AllGauges(f func(string, float64)) {
-	dm.storage.AllGauges(f)
+func (dm *defaultMetricsService) AllGauges(f func(string, float64)) error {
+	return dm.storage.AllGauges(f)
 }
 
-func (dm *defaultMetricsService) SaveCounter(name string, v int64) int64 {
-	value, _ := dm.storage.GetCounter(name)
-	result := value + v
-	dm.storage.SaveCounter(name, result)
-	return result
+func (dm *defaultMetricsService) SaveCounter(name string, v int64) (int64, error) {
+	return dm.storage.IncrementCounter(name, v)
 }
 
-func (dm *defaultMetricsService) GetCounter(name string) (int64, bool) {
+func (dm *defaultMetricsService) GetCounter(name string) (int64, bool, error) {
 	return dm.storage.GetCounter(name)
 }
 
-func (dm *defaultMetricsService) AllCounters(f func(string, int64)) {
-	dm.storage.AllCounters(f)
+func (dm *defaultMetricsService) AllCounters(f func(string, int64)) error {
+	return dm.storage.AllCounters(f)
+}
+
+func (dm *defaultMetricsService) GetHistogram(name string) (model.Histogram, bool, error) {
+	return dm.storage.GetHistogram(name)
+}
+
+func (dm *defaultMetricsService) AllHistograms(f func(string, model.Histogram)) error {
+	return dm.storage.AllHistograms(f)
+}
+
+func (dm *defaultMetricsService) Ping() error {
+	return dm.storage.Ping()
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		result[k] = v
+	}
+	return result
+}
+
+func (dm *defaultMetricsService) AllMetrics(filter map[string]string) ([]model.Metrics, error) {
+	var result []model.Metrics
+	var addErr error
+	add := func(key string, m model.Metrics) {
+		id, labels, err := model.ParseMetricKey(key)
+		if err != nil {
+			addErr = fmt.Errorf("%s: %w", key, err)
+			return
+		}
+		if !model.MatchLabels(labels, filter) {
+			return
+		}
+		m.ID, m.Labels = id, labels
+		if err := dm.addTimestamp(&m, key); err != nil {
+			addErr = err
+			return
+		}
+		result = append(result, m)
+	}
+	err := dm.AllGauges(func(key string, v float64) {
+		add(key, model.Metrics{MType: "gauge", Value: &v})
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = dm.AllCounters(func(key string, v int64) {
+		add(key, model.Metrics{MType: "counter", Delta: &v})
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = dm.AllHistograms(func(key string, h model.Histogram) {
+		add(key, model.Metrics{MType: "histogram", Histogram: &h})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if addErr != nil {
+		return nil, addErr
+	}
+	return result, nil
 }
 
 func (dm *defaultMetricsService) saveCounterStruct(m *model.Metrics) (*model.Metrics, error) {
-	result := &model.Metrics{ID: m.ID, MType: m.MType}
-	if strings.TrimSpace(m.ID) == "" {
-		return nil, ErrIDRequired
+	result := &model.Metrics{ID: m.ID, MType: m.MType, Labels: copyLabels(m.Labels)}
+	if err := validate(m); err != nil {
+		return nil, err
 	}
-	if m.Delta == nil {
-		return nil, ErrDeltaRequired
+	newDelta, err := dm.SaveCounter(m.Key(), *m.Delta)
+	if err != nil {
+		return nil, notApplied(err)
 	}
-	newDelta := dm.SaveCounter(m.ID, *m.Delta)
 	result.Delta = &newDelta
-	return result, nil
+	return withTimestamp(result, time.Now()), nil
 }
 
 func (dm *defaultMetricsService) saveGaugeStruct(m *model.Metrics) (*model.Metrics, error) {
-	result := &model.Metrics{ID: m.ID, MType: m.MType}
-	if strings.TrimSpace(m.ID) == "" {
-		return nil, ErrIDRequired
+	result := &model.Metrics{ID: m.ID, MType: m.MType, Labels: copyLabels(m.Labels)}
+	if err := validate(m); err != nil {
+		return nil, err
 	}
-	if m.Value == nil {
-		return nil, ErrValueRequired
+	if err := dm.SaveGauge(m.Key(), *m.Value); err != nil {
+		return nil, notApplied(err)
 	}
-	dm.SaveGauge(m.ID, *m.Value)
 	newValue := *m.Value
 	result.Value = &newValue
+	return withTimestamp(result, time.Now()), nil
+}
+
+func (dm *defaultMetricsService) saveHistogramStruct(m *model.Metrics) (*model.Metrics, error) {
+	result := &model.Metrics{ID: m.ID, MType: m.MType, Labels: copyLabels(m.Labels)}
+	if err := validate(m); err != nil {
+		return nil, err
+	}
+	h, err := dm.storage.MergeHistogram(m.Key(), *m.Histogram)
+	if err != nil {
+		return nil, notApplied(err)
+	}
+	result.Histogram = &h
+	return withTimestamp(result, time.Now()), nil
+}
+
+func notApplied(err error) error {
+	if repository.IsNotApplied(err) {
+		return fmt.Errorf("%w: %w", ErrNotApplied, err)
+	}
+	return err
+}
+
+func validate(m *model.Metrics) error {
+	if strings.TrimSpace(m.ID) == "" {
+		return ErrIDRequired
+	}
+	if strings.ContainsAny(m.ID, "{}") {
+		return ErrInvalidLabels
+	}
+	for k := range m.Labels {
+		if !model.ValidLabelName(k) {
+			return ErrInvalidLabels
+		}
+	}
+	switch m.MType {
+	case "counter":
+		if m.Delta == nil {
+			return ErrDeltaRequired
+		}
+	case "gauge":
+		if m.Value == nil {
+			return ErrValueRequired
+		}
+	case "histogram":
+		if m.Histogram == nil {
+			return ErrHistogramRequired
+		}
+		if err := m.Histogram.Validate(); err != nil {
+			return err
+		}
+	default:
+		return ErrInvalidMType
+	}
+	return nil
+}
+
+func (dm *defaultMetricsService) SaveBatch(ms []model.Metrics) ([]model.Metrics, error) {
+	for i := range ms {
+		if err := validate(&ms[i]); err != nil {
+			return nil, fmt.Errorf("metric %d (%s): %w", i, ms[i].ID, err)
+		}
+	}
+
+	deltas := repository.Batch{
+		Counters:   make(map[string]int64),
+		Gauges:     make(map[string]float64),
+		Histograms: make(map[string]model.Histogram),
+	}
+	for _, m := range ms {
+		if at, ok := clientTime(&m, dm.ttl); ok {
+			if deltas.Updated == nil {
+				deltas.Updated = make(map[string]map[string]time.Time)
+			}
+			if deltas.Updated[m.MType] == nil {
+				deltas.Updated[m.MType] = make(map[string]time.Time)
+			}
+			if at.After(deltas.Updated[m.MType][m.Key()]) {
+				deltas.Updated[m.MType][m.Key()] = at
+			}
+		}
+		switch m.MType {
+		case "counter":
+			deltas.Counters[m.Key()] += *m.Delta
+		case "gauge":
+			deltas.Gauges[m.Key()] = *m.Value
+		case "histogram":
+			if h, found := deltas.Histograms[m.Key()]; found {
+				deltas.Histograms[m.Key()] = h.Merge(*m.Histogram)
+			} else {
+				deltas.Histograms[m.Key()] = m.Histogram.Clone()
+			}
+		}
+	}
+
+	totals, err := dm.storage.SaveBatch(deltas)
+	if err != nil {
+		return nil, notApplied(err)
+	}
+
+	now := time.Now()
+	result := make([]model.Metrics, len(ms))
+	for i := len(ms) - 1; i >= 0; i-- {
+		m := ms[i]
+		result[i] = model.Metrics{ID: m.ID, MType: m.MType, Labels: copyLabels(m.Labels)}
+		switch m.MType {
+		case "counter":
+			value := totals.Counters[m.Key()]
+			totals.Counters[m.Key()] -= *m.Delta
+			result[i].Delta = &value
+		case "gauge":
+			value := *m.Value
+			result[i].Value = &value
+		case "histogram":
+			h := totals.Histograms[m.Key()].Clone()
+			result[i].Histogram = &h
+		}
+		at, found := deltas.Updated[m.MType][m.Key()]
+		if !found {
+			at = now
+		}
+		withTimestamp(&result[i], at)
+	}
 	return result, nil
 }
 
 func (dm *defaultMetricsService) Save(m *model.Metrics) (*model.Metrics, error) {
+	if _, ok := clientTime(m, dm.ttl); ok {
+		// only a batch stores the client time together with the value
+		if err := validate(m); err != nil {
+			return nil, err
+		}
+		result, err := dm.SaveBatch([]model.Metrics{*m})
+		if err != nil {
+			return nil, err
+		}
+		return &result[0], nil
+	}
 	switch metricType := m.MType; metricType {
 	case "counter":
 		return dm.saveCounterStruct(m)
 	case "gauge":
 		return dm.saveGaugeStruct(m)
+	case "histogram":
+		return dm.saveHistogramStruct(m)
 	default:
 		return nil, ErrInvalidMType
 	}
 }
 
 func (dm *defaultMetricsService) valueCounterStruct(m *model.Metrics) (*model.Metrics, error) {
-	if delta, ok := dm.GetCounter(m.ID); ok {
+	delta, ok, err := dm.GetCounter(m.Key())
+	if err != nil {
+		return nil, err
+	}
+	if ok {
 		m.Delta = &delta
-		return m, nil
+		return m, dm.addTimestamp(m, m.Key())
 	}
 	return nil, ErrIDNotFound
 }
 
 func (dm *defaultMetricsService) valueGaugeStruct(m *model.Metrics) (*model.Metrics, error) {
-	if value, ok := dm.GetGauge(m.ID); ok {
+	value, ok, err := dm.GetGauge(m.Key())
+	if err != nil {
+		return nil, err
+	}
+	if ok {
 		m.Value = &value
-		return m, nil
+		return m, dm.addTimestamp(m, m.Key())
 	}
 	return nil, ErrIDNotFound
 }
 
+func (dm *defaultMetricsService) valueHistogramStruct(m *model.Metrics) (*model.Metrics, error) {
+	h, ok, err := dm.GetHistogram(m.Key())
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		m.Histogram = &h
+		return m, dm.addTimestamp(m, m.Key())
+	}
+	return nil, ErrIDNotFound
+}
+
+// resolve replaces the labels of m with those of the only stored series of the same name and type
+// whose labels include them. It reports false when there is no such series or more than one.
+func (dm *defaultMetricsService) resolve(m *model.Metrics) (bool, error) {
+	var labels map[string]string
+	matches := 0
+	err := dm.storage.Scan(repository.ScanPosition{Key: m.ID}, false, func(s model.Metrics) bool {
+		if !strings.HasPrefix(s.ID, m.ID) {
+			return false
+		}
+		if s.MType != m.MType {
+			return true
+		}
+		id, l, err := model.ParseMetricKey(s.ID)
+		if err != nil || id != m.ID || !model.MatchLabels(l, m.Labels) {
+			return true
+		}
+		labels = l
+		matches++
+		return matches < 2
+	})
+	if err != nil || matches != 1 {
+		return false, err
+	}
+	m.Labels = labels
+	return true, nil
+}
+
 func (dm *defaultMetricsService) Value(m *model.Metrics) (*model.Metrics, error) {
-	result := &model.Metrics{ID: m.ID, MType: m.MType}
-	switch m.MType {
+	result := &model.Metrics{ID: m.ID, MType: m.MType, Labels: copyLabels(m.Labels)}
+	value, err := dm.value(result)
+	if !errors.Is(err, ErrIDNotFound) {
+		return value, err
+	}
+	if ok, err := dm.resolve(result); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrIDNotFound
+	}
+	return dm.value(result)
+}
+
+func (dm *defaultMetricsService) value(result *model.Metrics) (*model.Metrics, error) {
+	switch result.MType {
 	case "counter":
 		return dm.valueCounterStruct(result)
 	case "gauge":
 		return dm.valueGaugeStruct(result)
+	case "histogram":
+		return dm.valueHistogramStruct(result)
 	default:
 		return nil, ErrInvalidMType
 	}
 }
 
+func (dm *defaultMetricsService) History(m *model.Metrics, from, to time.Time, step time.Duration) ([]model.Point, error) {
+	if strings.TrimSpace(m.ID) == "" {
+		return nil, ErrIDRequired
+	}
+	var points []model.Point
+	var found bool
+	var err error
+	switch m.MType {
+	case "counter":
+		if points, err = dm.storage.CounterHistory(m.Key(), from, to); err == nil && len(points) == 0 {
+			_, found, err = dm.GetCounter(m.Key())
+		}
+	case "gauge":
+		if points, err = dm.storage.GaugeHistory(m.Key(), from, to); err == nil && len(points) == 0 {
+			_, found, err = dm.GetGauge(m.Key())
+		}
+	default:
+		return nil, ErrInvalidMType
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 0 {
+		if !found {
+			return nil, ErrIDNotFound
+		}
+		return []model.Point{}, nil
+	}
+
+	start := from
+	if start.IsZero() {
+		start = points[0].Time
+	}
+	if span := points[len(points)-1].Time.Sub(start); step == 0 && len(points) > maxHistoryPoints {
+		step = (span/maxHistoryPoints + time.Second).Truncate(time.Second)
+	}
+	if step > 0 {
+		return model.Downsample(points, start, step), nil
+	}
+	return points, nil
+}
+
 func NewMetricsService(repository repository.Storage) *defaultMetricsService {
-	return &defaultMetricsService{repository, validator.New()}
+	return NewMetricsServiceWithTTL(repository, 0)
+}
+
+func NewMetricsServiceWithTTL(repository repository.Storage, ttl time.Duration) *defaultMetricsService {
+	return &defaultMetricsService{repository, validator.New(), ttl}
+}
+
+// clientTime returns the client timestamp of m if it is in the past, with a TTL never earlier than the TTL ago.
+// Metrics without one are stamped by the storage when written.
+func clientTime(m *model.Metrics, ttl time.Duration) (time.Time, bool) {
+	now := time.Now()
+	if m.Timestamp == nil || !m.Timestamp.Before(now) {
+		return now, false
+	}
+	if oldest := now.Add(-ttl); ttl > 0 && m.Timestamp.Before(oldest) {
+		return oldest, true
+	}
+	return *m.Timestamp, true
+}
+
+func withTimestamp(m *model.Metrics, at time.Time) *model.Metrics {
+	m.Timestamp = &at
+	return m
+}
+
+func (dm *defaultMetricsService) addTimestamp(m *model.Metrics, key string) error {
+	at, found, err := dm.storage.UpdatedAt(m.MType, key)
+	if err != nil || !found {
+		return err
+	}
+	m.Timestamp = &at
+	m.Stale = m.MType == "gauge" && dm.ttl > 0 && time.Since(at) > dm.ttl
+	return nil
+}
+
+func evictStale(storage repository.Storage, ttl time.Duration) error {
+	var names []string
+	if err := storage.AllGauges(func(name string, _ float64) { names = append(names, name) }); err != nil {
+		return err
+	}
+	for _, name := range names {
+		at, found, err := storage.UpdatedAt("gauge", name)
+		if err != nil {
+			return err
+		}
+		if found && time.Since(at) > ttl {
+			// the gauge may be updated meanwhile, so the storage checks the time again when deleting
+			if _, err := storage.DeleteGaugeIfNotUpdatedSince(name, time.Now().Add(-ttl)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func EvictStaleInBackground(ctx context.Context, storage repository.Storage, ttl, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := evictStale(storage, ttl); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}()
+	return done
 }
 
-func FlushStorageInBackground(storage repository.Storage, fname string, interval int) {
+func FlushStorageInBackground(ctx context.Context, storage repository.Storage, fname string, interval int) <-chan struct{} {
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
 		for {
-			time.Sleep(time.Duration(interval) * time.Second)
-			storage.WriteToFile(fname)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := storage.WriteToFile(fname); err != nil {
+					log.Println(err)
+				}
+			}
 		}
 	}()
+	return done
 }
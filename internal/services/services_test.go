@@ -1,44 +1,124 @@
 package services
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/javaman/go-metrics/internal/repository"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 type mockStorage struct {
 	mock.Mock
 }
 
-func (m *mockStorage) SaveGauge(name string, v float64) {
+func (m *mockStorage) SaveGauge(name string, v float64) error {
 	m.Called(name, v)
+	return nil
 }
 
-func (m *mockStorage) GetGauge(name string) (float64, bool) {
+func (m *mockStorage) GetGauge(name string) (float64, bool, error) {
 	args := m.Called(name)
-	return args.Get(0).(float64), args.Bool(1)
+	return args.Get(0).(float64), args.Bool(1), nil
 }
 
-func (m *mockStorage) AllGauges(f func(string, float64)) {
+func (m *mockStorage) AllGauges(f func(string, float64)) error {
 	m.Called(f)
+	return nil
 }
 
-func (m *mockStorage) SaveCounter(name string, v int64) {
+func (m *mockStorage) SaveCounter(name string, v int64) error {
 	m.Called(name, v)
+	return nil
 }
 
-func (m *mockStorage) GetCounter(name string) (int64, bool) {
+func (m *mockStorage) IncrementCounter(name string, delta int64) (int64, error) {
+	args := m.Called(name, delta)
+	return args.Get(0).(int64), nil
+}
+
+func (m *mockStorage) GetCounter(name string) (int64, bool, error) {
+	args := m.Called(name)
+	return args.Get(0).(int64), args.Bool(1), nil
+}
+
+func (m *mockStorage) AllCounters(f func(string, int64)) error {
+	m.Called(f)
+	return nil
+}
+
+func (m *mockStorage) SaveHistogram(name string, h model.Histogram) error {
+	m.Called(name, h)
+	return nil
+}
+
+func (m *mockStorage) MergeHistogram(name string, delta model.Histogram) (model.Histogram, error) {
+	args := m.Called(name, delta)
+	return args.Get(0).(model.Histogram), nil
+}
+
+func (m *mockStorage) GetHistogram(name string) (model.Histogram, bool, error) {
 	args := m.Called(name)
-	return args.Get(0).(int64), args.Bool(1)
+	return args.Get(0).(model.Histogram), args.Bool(1), nil
 }
 
-func (m *mockStorage) AllCounters(f func(string, int64)) {
+func (m *mockStorage) AllHistograms(f func(string, model.Histogram)) error {
 	m.Called(f)
+	return nil
+}
+
+func (m *mockStorage) SaveBatch(deltas repository.Batch) (repository.Batch, error) {
+	args := m.Called(deltas)
+	return args.Get(0).(repository.Batch), nil
+}
+
+func (m *mockStorage) GaugeHistory(name string, from, to time.Time) ([]model.Point, error) {
+	args := m.Called(name, from, to)
+	return args.Get(0).([]model.Point), args.Error(1)
+}
+
+func (m *mockStorage) CounterHistory(name string, from, to time.Time) ([]model.Point, error) {
+	args := m.Called(name, from, to)
+	return args.Get(0).([]model.Point), args.Error(1)
+}
+
+func (m *mockStorage) DeleteGauge(name string) error {
+	m.Called(name)
+	return nil
+}
+
+func (m *mockStorage) DeleteGaugeIfNotUpdatedSince(name string, at time.Time) (bool, error) {
+	args := m.Called(name, at)
+	return args.Bool(0), nil
 }
 
-func (m *mockStorage) WriteToFile(fname string) {
+func (m *mockStorage) Touch(mtype, name string, at time.Time) error {
+	m.Called(mtype, name, at)
+	return nil
+}
+
+func (m *mockStorage) UpdatedAt(mtype, name string) (time.Time, bool, error) {
+	return time.Time{}, false, nil
+}
+
+func (m *mockStorage) Ping() error {
+	return m.Called().Error(0)
+}
+
+func (m *mockStorage) Scan(after repository.ScanPosition, desc bool, f func(model.Metrics) bool) error {
+	return nil
+}
+
+func (m *mockStorage) WriteToFile(fname string) error {
 	m.Called(fname)
+	return nil
 }
 
 func TestSaveGauge(t *testing.T) {
@@ -55,7 +135,7 @@ func TestGetGauge(t *testing.T) {
 	theMock := &mockStorage{}
 	theMock.On("GetGauge", "one").Return(3.14, true)
 	ms := NewMetricsService(theMock)
-	if v, ok := ms.GetGauge("one"); ok {
+	if v, ok, _ := ms.GetGauge("one"); ok {
 		assert.Equal(t, v, 3.14, "That should not happen")
 	} else {
 		assert.Fail(t, "Ooops")
@@ -78,24 +158,24 @@ func TestAllGauges(t *testing.T) {
 
 func TestSaveCounter(t *testing.T) {
 	theMock := &mockStorage{}
-	theMock.On("GetCounter", "one").Return(int64(0), false)
-	theMock.On("SaveCounter", "one", int64(1))
+	theMock.On("IncrementCounter", "one", int64(1)).Return(int64(1))
 	ms := NewMetricsService(theMock)
-	ms.SaveCounter("one", 1)
-	theMock.AssertCalled(t, "GetCounter", "one")
-	theMock.AssertCalled(t, "SaveCounter", "one", int64(1))
+	v, err := ms.SaveCounter("one", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), v)
+	theMock.AssertCalled(t, "IncrementCounter", "one", int64(1))
 	theMock.AssertExpectations(t)
 	mock.AssertExpectationsForObjects(t, theMock)
 }
 
 func TestSaveCounterUpdate(t *testing.T) {
 	theMock := &mockStorage{}
-	theMock.On("GetCounter", "one").Return(int64(3), true)
-	theMock.On("SaveCounter", "one", int64(4))
+	theMock.On("IncrementCounter", "one", int64(1)).Return(int64(4))
 	ms := NewMetricsService(theMock)
-	ms.SaveCounter("one", 1)
-	theMock.AssertCalled(t, "GetCounter", "one")
-	theMock.AssertCalled(t, "SaveCounter", "one", int64(4))
+	v, err := ms.SaveCounter("one", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), v)
+	theMock.AssertCalled(t, "IncrementCounter", "one", int64(1))
 	theMock.AssertExpectations(t)
 	mock.AssertExpectationsForObjects(t, theMock)
 }
@@ -104,7 +184,7 @@ func TestGetCounter(t *testing.T) {
 	theMock := &mockStorage{}
 	theMock.On("GetCounter", "one").Return(int64(42), true)
 	ms := NewMetricsService(theMock)
-	if v, ok := ms.GetCounter("one"); ok {
+	if v, ok, _ := ms.GetCounter("one"); ok {
 		assert.Equal(t, v, int64(42), "That should not happen")
 	} else {
 		assert.Fail(t, "Ooops")
@@ -124,3 +204,205 @@ func TestAllCounters(t *testing.T) {
 	theMock.AssertExpectations(t)
 	mock.AssertExpectationsForObjects(t, theMock)
 }
+
+func TestSaveBatch(t *testing.T) {
+	theMock := &mockStorage{}
+	theMock.On("SaveBatch", repository.Batch{
+		Counters:   map[string]int64{"one": int64(3)},
+		Gauges:     map[string]float64{"pi": 3.14},
+		Histograms: map[string]model.Histogram{},
+	}).Return(repository.Batch{Counters: map[string]int64{"one": int64(6)}})
+	ms := NewMetricsService(theMock)
+	d1, d2, v := int64(1), int64(2), 3.14
+	res, err := ms.SaveBatch([]model.Metrics{
+		{ID: "one", MType: "counter", Delta: &d1},
+		{ID: "pi", MType: "gauge", Value: &v},
+		{ID: "one", MType: "counter", Delta: &d2},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(res))
+	assert.Equal(t, int64(4), *res[0].Delta)
+	assert.Equal(t, 3.14, *res[1].Value)
+	assert.Equal(t, int64(6), *res[2].Delta)
+	theMock.AssertExpectations(t)
+}
+
+func TestSaveBatchClientTimes(t *testing.T) {
+	at := time.Now().Add(-time.Minute).Truncate(time.Second)
+	later := at.Add(time.Second)
+	theMock := &mockStorage{}
+	theMock.On("SaveBatch", repository.Batch{
+		Counters:   map[string]int64{"one": int64(3)},
+		Gauges:     map[string]float64{"pi": 3.14},
+		Histograms: map[string]model.Histogram{},
+		Updated:    map[string]map[string]time.Time{"counter": {"one": later}},
+	}).Return(repository.Batch{Counters: map[string]int64{"one": int64(3)}})
+	theMock.On("SaveBatch", repository.Batch{
+		Counters:   map[string]int64{},
+		Gauges:     map[string]float64{"e": 2.72},
+		Histograms: map[string]model.Histogram{},
+		Updated:    map[string]map[string]time.Time{"gauge": {"e": at}},
+	}).Return(repository.Batch{})
+	ms := NewMetricsService(theMock)
+	d1, d2, v, e := int64(1), int64(2), 3.14, 2.72
+	res, err := ms.SaveBatch([]model.Metrics{
+		{ID: "one", MType: "counter", Delta: &d1, Timestamp: &later},
+		{ID: "pi", MType: "gauge", Value: &v},
+		{ID: "one", MType: "counter", Delta: &d2, Timestamp: &at},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, later, *res[0].Timestamp)
+	assert.Equal(t, later, *res[2].Timestamp)
+	assert.WithinDuration(t, time.Now(), *res[1].Timestamp, time.Second)
+
+	m, err := ms.Save(&model.Metrics{ID: "e", MType: "gauge", Value: &e, Timestamp: &at})
+	require.NoError(t, err)
+	assert.Equal(t, at, *m.Timestamp)
+	theMock.AssertExpectations(t)
+	theMock.AssertNotCalled(t, "Touch", mock.Anything, mock.Anything, mock.Anything)
+}
+
+type failingStorage struct {
+	repository.Storage
+	err error
+}
+
+func (f failingStorage) SaveBatch(repository.Batch) (repository.Batch, error) {
+	return repository.Batch{}, f.err
+}
+
+func (f failingStorage) IncrementCounter(string, int64) (int64, error) {
+	return 0, f.err
+}
+
+func TestSaveNotApplied(t *testing.T) {
+	d := int64(1)
+	ms := NewMetricsService(failingStorage{repository.NewInMemoryStorage(), fmt.Errorf("dial: %w", syscall.ECONNREFUSED)})
+	_, err := ms.SaveBatch([]model.Metrics{{ID: "c", MType: "counter", Delta: &d}})
+	assert.ErrorIs(t, err, ErrNotApplied)
+	_, err = ms.Save(&model.Metrics{ID: "c", MType: "counter", Delta: &d})
+	assert.ErrorIs(t, err, ErrNotApplied)
+
+	ms = NewMetricsService(failingStorage{repository.NewInMemoryStorage(), fmt.Errorf("read: %w", syscall.ECONNRESET)})
+	_, err = ms.SaveBatch([]model.Metrics{{ID: "c", MType: "counter", Delta: &d}})
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrNotApplied)
+}
+
+func TestSaveBatchInvalid(t *testing.T) {
+	theMock := &mockStorage{}
+	ms := NewMetricsService(theMock)
+	d := int64(1)
+	_, err := ms.SaveBatch([]model.Metrics{
+		{ID: "one", MType: "counter", Delta: &d},
+		{ID: "two", MType: "gauge"},
+	})
+	assert.ErrorIs(t, err, ErrValueRequired)
+	theMock.AssertNotCalled(t, "SaveBatch", mock.Anything)
+}
+
+func TestSaveHistogram(t *testing.T) {
+	delta := model.NewHistogram([]float64{1})
+	delta.Observe(0.5)
+	merged := delta.Merge(delta)
+	theMock := &mockStorage{}
+	theMock.On("MergeHistogram", "h1", delta).Return(merged)
+	ms := NewMetricsService(theMock)
+
+	res, err := ms.Save(&model.Metrics{ID: "h1", MType: "histogram", Histogram: &delta})
+	assert.NoError(t, err)
+	assert.Equal(t, merged, *res.Histogram)
+
+	_, err = ms.Save(&model.Metrics{ID: "h1", MType: "histogram"})
+	assert.ErrorIs(t, err, ErrHistogramRequired)
+	_, err = ms.Save(&model.Metrics{ID: "h1", MType: "histogram", Histogram: &model.Histogram{Bounds: []float64{1}}})
+	assert.ErrorIs(t, err, ErrInvalidHistogram)
+	theMock.AssertNumberOfCalls(t, "MergeHistogram", 1)
+}
+
+func TestHistory(t *testing.T) {
+	start := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	var points []model.Point
+	for i := 0; i < 2*maxHistoryPoints; i++ {
+		points = append(points, model.Point{Time: start.Add(time.Duration(i) * time.Second), Value: float64(i)})
+	}
+	end := points[len(points)-1].Time
+	theMock := &mockStorage{}
+	theMock.On("GaugeHistory", "g1", start, end).Return(points, nil)
+	theMock.On("GaugeHistory", "g2", start, end).Return([]model.Point{}, nil)
+	theMock.On("GetGauge", "g2").Return(0.0, false)
+	ms := NewMetricsService(theMock)
+
+	res, err := ms.History(&model.Metrics{ID: "g1", MType: "gauge"}, start, end, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, maxHistoryPoints, len(res))
+	assert.Equal(t, 0.5, res[0].Value)
+	assert.Equal(t, 2, res[0].Count)
+
+	res, err = ms.History(&model.Metrics{ID: "g1", MType: "gauge"}, start, end, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 34, len(res))
+
+	_, err = ms.History(&model.Metrics{ID: "g2", MType: "gauge"}, start, end, 0)
+	assert.ErrorIs(t, err, ErrIDNotFound)
+	_, err = ms.History(&model.Metrics{ID: "h1", MType: "histogram"}, start, end, 0)
+	assert.ErrorIs(t, err, ErrInvalidMType)
+}
+
+func TestStaleGauges(t *testing.T) {
+	storage, err := repository.MakeStorageWithTimestamps(repository.NewInMemoryStorage())
+	assert.NoError(t, err)
+	ms := NewMetricsServiceWithTTL(storage, time.Minute)
+
+	old := time.Now().Add(-time.Hour)
+	v := 1.0
+	res, err := ms.Save(&model.Metrics{ID: "old", MType: "gauge", Value: &v, Timestamp: &old})
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(-time.Minute), *res.Timestamp, time.Second)
+	recent := time.Now().Add(-time.Second)
+	res, err = ms.Save(&model.Metrics{ID: "recent", MType: "gauge", Value: &v, Timestamp: &recent})
+	assert.NoError(t, err)
+	assert.Equal(t, recent, *res.Timestamp)
+	future := time.Now().Add(time.Hour)
+	res, err = ms.Save(&model.Metrics{ID: "fresh", MType: "gauge", Value: &v, Timestamp: &future})
+	assert.NoError(t, err)
+	assert.True(t, res.Timestamp.Before(future))
+
+	res, err = ms.Value(&model.Metrics{ID: "old", MType: "gauge"})
+	assert.NoError(t, err)
+	assert.True(t, res.Stale)
+	res, err = ms.Value(&model.Metrics{ID: "fresh", MType: "gauge"})
+	assert.NoError(t, err)
+	assert.False(t, res.Stale)
+
+	assert.NoError(t, evictStale(storage, time.Minute))
+	all, err := ms.AllMetrics(nil)
+	assert.NoError(t, err)
+	var ids []string
+	for _, m := range all {
+		ids = append(ids, m.ID)
+		assert.NotNil(t, m.Timestamp)
+	}
+	assert.ElementsMatch(t, []string{"fresh", "recent"}, ids)
+}
+
+func TestPing(t *testing.T) {
+	theMock := &mockStorage{}
+	theMock.On("Ping").Return(errors.New("connection refused"))
+	ms := NewMetricsService(theMock)
+	assert.EqualError(t, ms.Ping(), "connection refused")
+	theMock.AssertExpectations(t)
+}
+
+func TestFlushStorageInBackgroundStops(t *testing.T) {
+	theMock := &mockStorage{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := FlushStorageInBackground(ctx, theMock, "db.json", 1)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "flush loop did not stop")
+	}
+	theMock.AssertNotCalled(t, "WriteToFile", mock.Anything)
+}
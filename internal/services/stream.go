@@ -0,0 +1,169 @@
+package services
+
+import (
+	"errors"
+	"path"
+	"sync"
+	"sync/atomic"
+
+	"github.com/javaman/go-metrics/internal/model"
+)
+
+var ErrInvalidFilter = errors.New("invalid stream filter")
+
+// StreamFilter selects metrics by type and by an ID pattern in path.Match syntax. Empty fields match everything.
+type StreamFilter struct {
+	Types []string `json:"types,omitempty"`
+	Name  string   `json:"name,omitempty"`
+}
+
+func (f StreamFilter) Validate() error {
+	for _, t := range f.Types {
+		if t != "gauge" && t != "counter" && t != "histogram" {
+			return ErrInvalidFilter
+		}
+	}
+	if _, err := path.Match(f.Name, ""); err != nil {
+		return ErrInvalidFilter
+	}
+	return nil
+}
+
+func (f StreamFilter) Match(m *model.Metrics) bool {
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			found = found || t == m.MType
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Name == "" {
+		return true
+	}
+	ok, _ := path.Match(f.Name, m.ID)
+	return ok
+}
+
+// Subscription receives saved metrics on C. Metrics that do not fit into the buffer of a slow
+// subscriber are dropped and counted rather than holding up the writers.
+type Subscription struct {
+	C       <-chan model.Metrics
+	ch      chan model.Metrics
+	hub     *Hub
+	filter  atomic.Value
+	dropped atomic.Int64
+}
+
+func (s *Subscription) SetFilter(f StreamFilter) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	s.filter.Store(f)
+	return nil
+}
+
+// Dropped returns the number of metrics dropped since the previous call.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Swap(0)
+}
+
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	delete(s.hub.subscriptions, s)
+}
+
+type Hub struct {
+	mu            sync.RWMutex
+	subscriptions map[*Subscription]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subscriptions: make(map[*Subscription]struct{})}
+}
+
+func (h *Hub) Subscribe(f StreamFilter, buffer int) (*Subscription, error) {
+	ch := make(chan model.Metrics, buffer)
+	s := &Subscription{C: ch, ch: ch, hub: h}
+	if err := s.SetFilter(f); err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscriptions[s] = struct{}{}
+	return s, nil
+}
+
+func (h *Hub) publish(ms ...model.Metrics) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subscriptions {
+		filter := s.filter.Load().(StreamFilter)
+		for i := range ms {
+			if !filter.Match(&ms[i]) {
+				continue
+			}
+			select {
+			case s.ch <- ms[i]:
+			default:
+				s.dropped.Add(1)
+			}
+		}
+	}
+}
+
+type streamingService struct {
+	MetricsService
+	hub *Hub
+}
+
+// MakeServiceStreaming publishes every metric saved through service to the hub's subscribers.
+func MakeServiceStreaming(service MetricsService, hub *Hub) MetricsService {
+	return &streamingService{service, hub}
+}
+
+func (s *streamingService) publishKey(key, mtype string, m model.Metrics) {
+	id, labels, err := model.ParseMetricKey(key)
+	if err != nil {
+		return
+	}
+	m.ID, m.MType, m.Labels = id, mtype, labels
+	s.hub.publish(m)
+}
+
+func (s *streamingService) SaveGauge(name string, v float64) error {
+	if err := s.MetricsService.SaveGauge(name, v); err != nil {
+		return err
+	}
+	s.publishKey(name, "gauge", model.Metrics{Value: &v})
+	return nil
+}
+
+func (s *streamingService) SaveCounter(name string, v int64) (int64, error) {
+	total, err := s.MetricsService.SaveCounter(name, v)
+	if err != nil {
+		return total, err
+	}
+	s.publishKey(name, "counter", model.Metrics{Delta: &total})
+	return total, nil
+}
+
+func (s *streamingService) Save(m *model.Metrics) (*model.Metrics, error) {
+	result, err := s.MetricsService.Save(m)
+	if err != nil {
+		return nil, err
+	}
+	s.hub.publish(*result)
+	return result, nil
+}
+
+func (s *streamingService) SaveBatch(ms []model.Metrics) ([]model.Metrics, error) {
+	result, err := s.MetricsService.SaveBatch(ms)
+	if err != nil {
+		return nil, err
+	}
+	s.hub.publish(result...)
+	return result, nil
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/javaman/go-metrics/internal/model"
+	"github.com/javaman/go-metrics/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamFilter(t *testing.T) {
+	v := 1.0
+	gauge := &model.Metrics{ID: "HeapAlloc", MType: "gauge", Value: &v}
+
+	assert.True(t, StreamFilter{}.Match(gauge))
+	assert.True(t, StreamFilter{Types: []string{"counter", "gauge"}, Name: "Heap*"}.Match(gauge))
+	assert.False(t, StreamFilter{Types: []string{"counter"}}.Match(gauge))
+	assert.False(t, StreamFilter{Name: "Poll*"}.Match(gauge))
+
+	assert.ErrorIs(t, StreamFilter{Types: []string{"summary"}}.Validate(), ErrInvalidFilter)
+	assert.ErrorIs(t, StreamFilter{Name: "["}.Validate(), ErrInvalidFilter)
+}
+
+func TestStreamingService(t *testing.T) {
+	hub := NewHub()
+	service := MakeServiceStreaming(NewMetricsService(repository.NewInMemoryStorage()), hub)
+
+	all, err := hub.Subscribe(StreamFilter{}, 10)
+	require.NoError(t, err)
+	defer all.Close()
+	counters, err := hub.Subscribe(StreamFilter{Types: []string{"counter"}}, 1)
+	require.NoError(t, err)
+
+	delta := int64(2)
+	_, err = service.Save(&model.Metrics{ID: "PollCount", MType: "counter", Delta: &delta, Labels: map[string]string{"host": "a"}})
+	require.NoError(t, err)
+	require.NoError(t, service.SaveGauge(`HeapAlloc{host="a"}`, 3.5))
+	_, err = service.SaveBatch([]model.Metrics{{ID: "PollCount", MType: "counter", Delta: &delta}})
+	require.NoError(t, err)
+	_, err = service.Save(&model.Metrics{ID: "Bad", MType: "gauge"})
+	require.Error(t, err)
+
+	m := <-all.C
+	assert.Equal(t, "PollCount", m.ID)
+	assert.Equal(t, map[string]string{"host": "a"}, m.Labels)
+	assert.Equal(t, int64(2), *m.Delta)
+	m = <-all.C
+	assert.Equal(t, "HeapAlloc", m.ID)
+	assert.Equal(t, "gauge", m.MType)
+	assert.Equal(t, map[string]string{"host": "a"}, m.Labels)
+	assert.Equal(t, 3.5, *m.Value)
+	m = <-all.C
+	assert.Equal(t, "PollCount", m.ID)
+	assert.Empty(t, all.C)
+	assert.Zero(t, all.Dropped())
+
+	m = <-counters.C
+	assert.Equal(t, `PollCount{host="a"}`, m.Key())
+	assert.Empty(t, counters.C)
+	assert.Equal(t, int64(1), counters.Dropped())
+	assert.Zero(t, counters.Dropped())
+
+	counters.Close()
+	_, err = service.SaveCounter("PollCount", 1)
+	require.NoError(t, err)
+	assert.Empty(t, counters.C)
+	assert.Equal(t, 1, len(all.C))
+}